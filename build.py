@@ -62,6 +62,8 @@ def go_build_zip(arches, builder):
                                                                                     "domain_primary_sample "
                                                                                     "domain_alternative_sample "
                                                                                     "domain_ttl_sample "
+                                                                                    "zone_sample "
+                                                                                    "local_records_sample "
                                                                                     "config.yml", shell=True)
         except subprocess.CalledProcessError:
             print(o + " " + a + " " + (p[0] if p else "") + " failed.")
@@ -80,6 +82,15 @@ def create_sample_file():
         f.write("alternative.example")
     with open("./domain_ttl_sample", "w") as f:
         f.write("ttl.example 1000")
+    with open("./local_records_sample", "w") as f:
+        f.write("txt.example. IN TXT \"local record\"\n"
+                "*.wildcard.example. IN CNAME txt.example.\n")
+    with open("./zone_sample", "w") as f:
+        f.write("$TTL 3600\n"
+                "@ IN SOA ns.zone.example. admin.zone.example. 1 3600 600 86400 300\n"
+                "@ IN NS ns\n"
+                "ns IN A 127.0.0.11\n"
+                "www IN A 127.0.0.12\n")
 
 
 if __name__ == "__main__":
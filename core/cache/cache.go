@@ -8,10 +8,16 @@ package cache
 // Cache that holds RRs.
 
 import (
+	"bufio"
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
-	"sync"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -24,16 +30,25 @@ import (
 type elem struct {
 	expiration time.Time // time added + TTL, after this the elem is invalid
 	msg        *dns.Msg
+
+	ttl        time.Duration // TTL the elem has been inserted with
+	source     string        // name of the upstream group which produced msg
+	hits       uint32        // accessed atomically
+	prefetched time.Time     // last time a prefetch was started for this elem
+
+	element *list.Element // position of the elem in the recency list, its value is the key
+	size    int           // packed size of msg and the key in bytes
 }
 
 type elemData struct {
 	Expiration time.Time
 	Msg        []byte // dns.Msg cannot be converted to the json format successfully thus using its pack() method instead
+	Source     string
 }
 
 func (e *elem) MarshalBinary() (data []byte, err error) {
 	msgBytes, _ := e.msg.Pack()
-	ed := elemData{e.expiration, msgBytes}
+	ed := elemData{e.expiration, msgBytes, e.source}
 	return json.Marshal(ed)
 }
 
@@ -44,28 +59,48 @@ func (e *elem) UnmarshalBinary(data []byte) error {
 		return err
 	}
 	e.expiration = ed.Expiration
+	e.source = ed.Source
 	e.msg = &dns.Msg{}
 	return e.msg.Unpack(ed.Msg)
 }
 
-// Cache is a cache that holds on the a number of RRs or DNS messages. The cache
-// eviction is randomized.
-type Cache struct {
-	sync.RWMutex
+// StaleTTL is the TTL of answers served from expired entries, as recommended by RFC 8767.
+const StaleTTL = 30
+
+// prefetchRetry is the minimum interval between two prefetches of the same entry.
+const prefetchRetry = 5 * time.Second
 
+// Cache is a cache that holds on the a number of RRs or DNS messages. The local
+// table is sharded by the hash of the question, and the least recently used entries
+// of a shard are evicted once it has more than its part of capacity entries, or
+// their size exceeds its part of the byte budget if it is set.
+type Cache struct {
 	capacity    int
-	table       map[string]*elem
+	maxStale    time.Duration
+	shards      []*shard
 	redisClient *redis.Client
+
+	hits      uint64 // accessed atomically
+	misses    uint64 // accessed atomically
+	evictions uint64 // accessed atomically
+
+	prefetchHits      uint32
+	prefetchThreshold float64
+	ttlJitter         float64
 }
 
-// New returns a new cache with the capacity and the ttl specified.
-func New(capacity int, redisUrl string, cacheRedisConnectionPoolSize int) *Cache {
+// New returns a new cache with the capacity and the ttl specified. Expired entries
+// are kept for maxStale seconds so that they can be served when upstreams fail.
+func New(capacity int, redisUrl string, cacheRedisConnectionPoolSize int, maxStale int) *Cache {
 	if capacity <= 0 {
 		return nil
 	}
 	c := new(Cache)
-	c.table = make(map[string]*elem)
+	c.shards = newShards(capacity)
 	c.capacity = capacity
+	if maxStale > 0 {
+		c.maxStale = time.Duration(maxStale) * time.Second
+	}
 
 	opt, err := redis.ParseURL(redisUrl)
 	if err != nil {
@@ -87,43 +122,85 @@ func New(capacity int, redisUrl string, cacheRedisConnectionPoolSize int) *Cache
 
 func (c *Cache) Capacity() int { return c.capacity }
 
-func (c *Cache) Remove(s string) {
-	if c.redisClient != nil {
+// SetMaxBytes limits the total size of local entries, measured by the packed size of
+// their messages, to maxBytes besides the number of entries.
+func (c *Cache) SetMaxBytes(maxBytes int) {
+	if maxBytes <= 0 {
 		return
 	}
-	c.Lock()
-	delete(c.table, s)
-	c.Unlock()
+	for i, sh := range c.shards {
+		sh.Lock()
+		sh.maxBytes = split(maxBytes, len(c.shards), i)
+		sh.Unlock()
+	}
+}
+
+// Stats are the counters of a cache
+type Stats struct {
+	Length    int    `json:"length"`
+	Bytes     int    `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// Stats returns the counters of the cache, Length and Bytes are of the local cache only.
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for _, sh := range c.shards {
+		sh.RLock()
+		stats.Length += len(sh.table)
+		stats.Bytes += sh.bytes
+		sh.RUnlock()
+	}
+	return stats
 }
 
-// EvictRandom removes a random member a the cache.
-// Must be called under a write lock.
-func (c *Cache) EvictRandom() {
-	cacheLength := len(c.table)
-	if cacheLength <= c.capacity {
+// SetPrefetch enables prefetching of entries which have been hit at least minHits
+// times once less than threshold (a fraction of the original TTL) of their TTL is left.
+func (c *Cache) SetPrefetch(minHits int, threshold float64) {
+	if minHits <= 0 || threshold <= 0 {
 		return
 	}
-	i := c.capacity - cacheLength
-	for k := range c.table {
-		delete(c.table, k)
-		i--
-		if i == 0 {
-			break
-		}
+	c.prefetchHits = uint32(minHits)
+	c.prefetchThreshold = threshold
+}
+
+// SetTTLJitter makes every entry expire up to jitter (a fraction of its TTL) earlier,
+// so that entries inserted together do not expire together.
+func (c *Cache) SetTTLJitter(jitter float64) {
+	if jitter <= 0 || jitter >= 1 {
+		return
 	}
+	c.ttlJitter = jitter
+}
+
+func (c *Cache) Remove(s string) {
+	if c.redisClient != nil {
+		return
+	}
+	sh := c.shard(s)
+	sh.Lock()
+	sh.delete(s)
+	sh.Unlock()
 }
 
 // InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
-// should be a small (60...300) integer.
-func (c *Cache) InsertMessage(s string, m *dns.Msg, mTTL uint32) {
+// should be a small (60...300) integer. Source is the name of the upstream group which
+// produced the message, it is used to refresh the message when prefetching.
+func (c *Cache) InsertMessage(s string, m *dns.Msg, mTTL uint32, source string) {
 	if c.capacity <= 0 || m == nil {
 		return
 	}
 	var err error
 	if c.redisClient == nil {
-		c.InsertMessageToLocal(s, m, mTTL)
+		c.InsertMessageToLocal(s, m, mTTL, source)
 	} else {
-		err = c.InsertMessageToRedis(s, m, mTTL)
+		err = c.InsertMessageToRedis(s, m, mTTL, source)
 	}
 	if err != nil {
 		log.Warn("Insert cache failed", s, err)
@@ -132,31 +209,31 @@ func (c *Cache) InsertMessage(s string, m *dns.Msg, mTTL uint32) {
 	}
 }
 
-func (c *Cache) InsertMessageToRedis(s string, m *dns.Msg, mTTL uint32) error {
+func (c *Cache) InsertMessageToRedis(s string, m *dns.Msg, mTTL uint32, source string) error {
 
-	ttlDuration := convertToTTLDuration(m, mTTL)
-	if _, ok := c.table[s]; !ok {
-		e := &elem{time.Now().Add(ttlDuration), m.Copy()}
-		cmd := c.redisClient.Set(context.TODO(), s, e, ttlDuration)
-		if cmd.Err() != nil {
-			log.Warn("Redis set for cache failed!", cmd.Err())
-			return cmd.Err()
-		}
+	ttlDuration := c.jitter(convertToTTLDuration(m, mTTL))
+	e := &elem{expiration: time.Now().Add(ttlDuration), msg: m.Copy(), ttl: ttlDuration, source: source}
+	cmd := c.redisClient.Set(context.TODO(), s, e, ttlDuration+c.maxStale)
+	if cmd.Err() != nil {
+		log.Warn("Redis set for cache failed!", cmd.Err())
+		return cmd.Err()
 	}
 	return nil
 
 }
-func (c *Cache) InsertMessageToLocal(s string, m *dns.Msg, mTTL uint32) {
-
-	c.Lock()
-	ttlDuration := convertToTTLDuration(m, mTTL)
-	if _, ok := c.table[s]; !ok {
-		e := &elem{time.Now().Add(ttlDuration), m.Copy()}
-		c.table[s] = e
+func (c *Cache) InsertMessageToLocal(s string, m *dns.Msg, mTTL uint32, source string) {
+	ttlDuration := c.jitter(convertToTTLDuration(m, mTTL))
+	e := &elem{expiration: time.Now().Add(ttlDuration), msg: m.Copy(), ttl: ttlDuration, source: source}
+	if evicted := c.shard(s).set(s, e); evicted > 0 {
+		atomic.AddUint64(&c.evictions, uint64(evicted))
 	}
+}
 
-	c.EvictRandom()
-	c.Unlock()
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.ttlJitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Float64()*c.ttlJitter*float64(ttl))
 }
 
 func convertToTTLDuration(m *dns.Msg, mTTL uint32) time.Duration {
@@ -199,13 +276,10 @@ func (c *Cache) SearchFromRedis(s string) (*dns.Msg, time.Time, bool) {
 
 // todo: use finder implementation
 func (c *Cache) SearchFromLocal(s string) (*dns.Msg, time.Time, bool) {
-	c.RLock()
-	if e, ok := c.table[s]; ok {
-		e1 := e.msg.Copy()
-		c.RUnlock()
-		return e1, e.expiration, true
+	// Messages of entries are never changed, so they are copied out of the lock
+	if e, ok := c.shard(s).get(s); ok {
+		return e.msg.Copy(), e.expiration, true
 	}
-	c.RUnlock()
 	return nil, time.Time{}, false
 }
 
@@ -215,51 +289,219 @@ func Key(q dns.Question, ednsIP string) string {
 }
 
 // Hit returns a dns message from the cache. If the message's TTL is expired, nil
-// will be returned and the message is removed from the cache.
+// will be returned and the message is removed from the cache once it is out of
+// the stale window. Lookups are counted by Count, as an answer may be looked up
+// under several keys.
 func (c *Cache) Hit(key string, msgid uint16) *dns.Msg {
 	m, exp, hit := c.Search(key)
 	if hit {
 		// Cache hit! \o/
 		if time.Since(exp) < 0 {
-			m.Id = msgid
-			m.Compress = true
-			// Even if something ended up with the TC bit *in* the cache, set it to off
-			m.Truncated = false
-			for _, a := range m.Answer {
-				a.Header().Ttl = uint32(time.Since(exp).Seconds() * -1)
-			}
-			return m
+			return fresh(m, exp, msgid)
 		}
 		// Expired! /o\
-		c.Remove(key)
+		if time.Since(exp) > c.maxStale {
+			c.Remove(key)
+		}
 	}
 	return nil
 }
 
+// Count counts a lookup of an answer in the cache as a hit or a miss.
+func (c *Cache) Count(hit bool) {
+	if c == nil {
+		return
+	}
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// Peek returns a dns message from the cache like Hit does, but nothing is counted and
+// the recency and popularity of the entry are left alone.
+func (c *Cache) Peek(key string, msgid uint16) *dns.Msg {
+	if c.capacity <= 0 {
+		return nil
+	}
+	var m *dns.Msg
+	var exp time.Time
+	if c.redisClient == nil {
+		e, ok := c.shard(key).peek(key)
+		if !ok {
+			return nil
+		}
+		m, exp = e.msg.Copy(), e.expiration
+	} else {
+		var hit bool
+		if m, exp, hit = c.SearchFromRedis(key); !hit {
+			return nil
+		}
+	}
+	if time.Since(exp) >= 0 {
+		return nil
+	}
+	return fresh(m, exp, msgid)
+}
+
+// fresh prepares m, a copy of an entry expiring at exp, to answer the query msgid
+func fresh(m *dns.Msg, exp time.Time, msgid uint16) *dns.Msg {
+	m.Id = msgid
+	m.Compress = true
+	// Even if something ended up with the TC bit *in* the cache, set it to off
+	m.Truncated = false
+	for _, a := range m.Answer {
+		a.Header().Ttl = uint32(time.Since(exp).Seconds() * -1)
+	}
+	return m
+}
+
+// Stale returns a dns message from the cache even if its TTL is expired, as long
+// as it is within the stale window. Answers get StaleTTL as their TTL.
+func (c *Cache) Stale(key string, msgid uint16) *dns.Msg {
+	if c.maxStale <= 0 {
+		return nil
+	}
+	m, exp, hit := c.Search(key)
+	if !hit || time.Since(exp) > c.maxStale {
+		return nil
+	}
+	// Failures are never worth serving again
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	m.Id = msgid
+	m.Compress = true
+	m.Truncated = false
+	for _, a := range m.Answer {
+		a.Header().Ttl = StaleTTL
+	}
+	return m
+}
+
+// Prefetch reports whether the entry of key is popular and close enough to (or past)
+// its expiration to be refreshed in the background, along with the name of the upstream
+// group that should refresh it. Only local cache supports prefetching.
+func (c *Cache) Prefetch(key string) (source string, ok bool) {
+	if c.prefetchHits == 0 || c.redisClient != nil {
+		return "", false
+	}
+
+	sh := c.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	e, found := sh.table[key]
+	if !found || atomic.LoadUint32(&e.hits) < c.prefetchHits || time.Since(e.prefetched) < prefetchRetry {
+		return "", false
+	}
+	remaining := time.Until(e.expiration)
+	if remaining > time.Duration(c.prefetchThreshold*float64(e.ttl)) || remaining < -c.maxStale {
+		return "", false
+	}
+	e.prefetched = time.Now()
+	return e.source, true
+}
+
 // Dump returns all local dns cache information for debugging
 func (c *Cache) Dump(nobody bool) (rs map[string][]string, l int) {
 	if c.capacity <= 0 {
 		return
 	}
 
-	l = len(c.table)
-
 	rs = make(map[string][]string)
 
-	if nobody {
-		return
+	for _, sh := range c.shards {
+		sh.RLock()
+		l += len(sh.table)
+		if !nobody {
+			for k, e := range sh.table {
+				var vs []string
+
+				for _, a := range e.msg.Answer {
+					vs = append(vs, a.String())
+				}
+				rs[k] = vs
+			}
+		}
+		sh.RUnlock()
 	}
+	return
+}
 
-	c.RLock()
-	defer c.RUnlock()
+// Popular returns the questions of at most n local cache entries with the most hits.
+func (c *Cache) Popular(n int) []dns.Question {
+	if c.capacity <= 0 || c.redisClient != nil || n <= 0 {
+		return nil
+	}
 
-	for k, e := range c.table {
-		var vs []string
+	type popularity struct {
+		question dns.Question
+		hits     uint32
+	}
 
-		for _, a := range e.msg.Answer {
-			vs = append(vs, a.String())
+	var ps []popularity
+	for _, sh := range c.shards {
+		sh.RLock()
+		for _, e := range sh.table {
+			if len(e.msg.Question) == 0 {
+				continue
+			}
+			ps = append(ps, popularity{e.msg.Question[0], atomic.LoadUint32(&e.hits)})
 		}
-		rs[k] = vs
+		sh.RUnlock()
 	}
-	return
+
+	sort.Slice(ps, func(i, j int) bool { return ps[i].hits > ps[j].hits })
+	if len(ps) > n {
+		ps = ps[:n]
+	}
+	qs := make([]dns.Question, len(ps))
+	for i, p := range ps {
+		qs[i] = p.question
+	}
+	return qs
+}
+
+// SaveSnapshot writes the questions of the n most popular entries to path, one
+// "name type" pair per line, so that they can be resolved again after restart.
+func (c *Cache) SaveSnapshot(path string, n int) error {
+	qs := c.Popular(n)
+	if len(qs) == 0 {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, q := range qs {
+		fmt.Fprintf(w, "%s %s\n", q.Name, dns.TypeToString[q.Qtype])
+	}
+	return w.Flush()
+}
+
+// LoadSnapshot reads questions written by SaveSnapshot.
+func LoadSnapshot(path string) ([]dns.Question, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var qs []dns.Question
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if len(words) != 2 {
+			continue
+		}
+		if t, ok := dns.StringToType[words[1]]; ok {
+			qs = append(qs, dns.Question{Name: dns.Fqdn(words[0]), Qtype: t, Qclass: dns.ClassINET})
+		}
+	}
+	return qs, scanner.Err()
 }
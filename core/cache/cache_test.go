@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newAnswer(name string, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	rr, _ := dns.NewRR(name + " IN A 1.2.3.4")
+	rr.Header().Ttl = ttl
+	m.Answer = []dns.RR{rr}
+	return m
+}
+
+func TestCache_Stale(t *testing.T) {
+	c := New(10, "", 0, 60)
+	m := newAnswer("example.com.", 0)
+	key := Key(m.Question[0], "")
+	c.InsertMessage(key, m, 0, "Primary")
+	time.Sleep(10 * time.Millisecond)
+
+	if c.Hit(key, 1) != nil {
+		t.Error("expired entry should not be hit")
+	}
+	stale := c.Stale(key, 2)
+	if stale == nil {
+		t.Fatal("expired entry should be served as stale")
+	}
+	if stale.Id != 2 || stale.Answer[0].Header().Ttl != StaleTTL {
+		t.Errorf("unexpected stale answer: %s", stale)
+	}
+
+	c.InsertMessage(key, newAnswer("example.com.", 300), 0, "Primary")
+	if c.Hit(key, 3) == nil {
+		t.Error("stale entry should be replaced by fresh one")
+	}
+}
+
+func TestCache_StaleDisabled(t *testing.T) {
+	c := New(10, "", 0, 0)
+	m := newAnswer("example.com.", 0)
+	key := Key(m.Question[0], "")
+	c.InsertMessage(key, m, 0, "Primary")
+	time.Sleep(10 * time.Millisecond)
+
+	if c.Stale(key, 1) != nil {
+		t.Error("stale entry should not be served when disabled")
+	}
+}
+
+func TestCache_Prefetch(t *testing.T) {
+	c := New(10, "", 0, 0)
+	c.SetPrefetch(2, 0.5)
+	m := newAnswer("example.com.", 1)
+	key := Key(m.Question[0], "")
+	c.InsertMessage(key, m, 0, "Alternative")
+
+	c.Hit(key, 1)
+	c.Hit(key, 2)
+	if _, ok := c.Prefetch(key); ok {
+		t.Error("entry should not be prefetched early in its TTL")
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	source, ok := c.Prefetch(key)
+	if !ok || source != "Alternative" {
+		t.Errorf("popular entry should be prefetched by its source, got %q %v", source, ok)
+	}
+	if _, ok := c.Prefetch(key); ok {
+		t.Error("entry should not be prefetched twice in a row")
+	}
+}
+
+func TestCache_Snapshot(t *testing.T) {
+	c := New(10, "", 0, 0)
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		m := newAnswer(name, 300)
+		c.InsertMessage(Key(m.Question[0], ""), m, 0, "Primary")
+	}
+	for i := 0; i < 3; i++ {
+		c.Hit(Key(dns.Question{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, ""), 1)
+	}
+
+	f, err := ioutil.TempFile("", "cache_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := c.SaveSnapshot(f.Name(), 1); err != nil {
+		t.Fatal(err)
+	}
+	qs, err := LoadSnapshot(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 1 || qs[0].Name != "b.example.com." || qs[0].Qtype != dns.TypeA {
+		t.Errorf("unexpected snapshot: %v", qs)
+	}
+}
+
+func TestCache_Scope(t *testing.T) {
+	c := New(10, "", 0, 0)
+	withScope := func(m *dns.Msg, scope uint8) *dns.Msg {
+		m.SetEdns0(4096, false)
+		o := m.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: scope})
+		return m
+	}
+	q := dns.Question{Name: "cdn.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	m := withScope(newAnswer(q.Name, 300), 16)
+	key := c.ScopedKey(q, "198.51.100.0/24", m)
+	if key != Key(q, "198.51.0.0/16") {
+		t.Errorf("response should be cached under its scope, got key %q", key)
+	}
+	c.InsertMessage(key, m, 0, "Primary")
+
+	if k := c.MatchKey(q, "198.51.7.0/24"); k != key {
+		t.Errorf("subnet in the scope should match it, got key %q", k)
+	}
+	if k := c.MatchKey(q, "192.0.2.0/24"); k != Key(q, "192.0.2.0/24") {
+		t.Errorf("subnet out of the scope should not match it, got key %q", k)
+	}
+
+	global := withScope(newAnswer(q.Name, 300), 0)
+	c.InsertMessage(c.ScopedKey(q, "192.0.2.0/24", global), global, 0, "Primary")
+	if k := c.MatchKey(q, "192.0.2.0/24"); k != Key(q, "") {
+		t.Errorf("response of scope 0 should match every subnet, got key %q", k)
+	}
+	if k := c.MatchKey(q, "198.51.7.0/24"); k != key {
+		t.Errorf("longest scope should win, got key %q", k)
+	}
+
+	c.Remove(key)
+	for _, sh := range c.shards {
+		if len(sh.scopes) != 0 {
+			t.Errorf("scopes of removed entries should be removed, got %v", sh.scopes)
+		}
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c := New(2, "", 0, 0)
+	keys := make([]string, 3)
+	for i, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		m := newAnswer(name, 300)
+		keys[i] = Key(m.Question[0], "")
+		c.InsertMessage(keys[i], m, 0, "Primary")
+		if i == 1 {
+			// a is used more recently than b
+			c.Hit(keys[0], 1)
+		}
+	}
+	for i, want := range []bool{true, false, true} {
+		hit := c.Hit(keys[i], 1) != nil
+		c.Count(hit)
+		if hit != want {
+			t.Errorf("least recently used entry should be evicted, hit %s: %v", keys[i], hit)
+		}
+	}
+	if stats := c.Stats(); stats.Length != 2 || stats.Hits != 2 || stats.Misses != 1 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	m := newAnswer("d.example.com.", 300)
+	c.SetMaxBytes(m.Len() + len(Key(m.Question[0], "")))
+	c.InsertMessage(Key(m.Question[0], ""), m, 0, "Primary")
+	if stats := c.Stats(); stats.Length != 1 || stats.Bytes > m.Len()+len(Key(m.Question[0], "")) {
+		t.Errorf("entries should be evicted to the byte budget, got stats %+v", stats)
+	}
+}
+
+func TestCache_ExpiredRecency(t *testing.T) {
+	c := New(2, "", 0, 60)
+	expired, fresh := newAnswer("a.example.com.", 0), newAnswer("b.example.com.", 300)
+	c.InsertMessage(Key(expired.Question[0], ""), expired, 0, "Primary")
+	c.InsertMessage(Key(fresh.Question[0], ""), fresh, 0, "Primary")
+	time.Sleep(10 * time.Millisecond)
+
+	key := Key(expired.Question[0], "")
+	if c.Hit(key, 1) != nil || c.Stale(key, 1) == nil {
+		t.Fatal("expired entry should only be served as stale")
+	}
+	if e, _ := c.shard(key).peek(key); e.hits != 0 {
+		t.Errorf("expired entry should not be more popular, got %d hits", e.hits)
+	}
+	c.InsertMessage("c.example.com. 1 ", newAnswer("c.example.com.", 300), 0, "Primary")
+	if _, ok := c.shard(key).peek(key); ok {
+		t.Error("expired entry should stay the least recently used one")
+	}
+}
+
+func TestCache_Peek(t *testing.T) {
+	c := New(2, "", 0, 0)
+	a, b := newAnswer("a.example.com.", 300), newAnswer("b.example.com.", 300)
+	c.InsertMessage(Key(a.Question[0], ""), a, 0, "Primary")
+	c.InsertMessage(Key(b.Question[0], ""), b, 0, "Primary")
+
+	if m := c.Peek(Key(a.Question[0], ""), 1); m == nil || m.Id != 1 {
+		t.Fatalf("unexpected peeked answer %v", m)
+	}
+	if c.Peek("missing 1 ", 1) != nil {
+		t.Error("missing entry should not be peeked")
+	}
+	// a is still the least recently used entry
+	c.InsertMessage("c.example.com. 1 ", newAnswer("c.example.com.", 300), 0, "Primary")
+	if c.Peek(Key(a.Question[0], ""), 1) != nil || c.Peek(Key(b.Question[0], ""), 1) == nil {
+		t.Error("peek should not change the recency of entries")
+	}
+	if stats := c.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("peek should not be counted, got stats %+v", stats)
+	}
+}
+
+func TestCache_Shards(t *testing.T) {
+	c := New(10000, "", 0, 0)
+	capacity := 0
+	for _, sh := range c.shards {
+		capacity += sh.capacity
+	}
+	if len(c.shards) != 32 || capacity != 10000 {
+		t.Fatalf("unexpected %d shards of capacity %d", len(c.shards), capacity)
+	}
+	q := dns.Question{Name: "cdn.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if c.shard(Key(q, "")) != c.shard(Key(q, "192.0.2.0/24")) {
+		t.Error("entries of a question should be in the same shard")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				m := newAnswer(fmt.Sprintf("%d.%d.example.com.", i, j), 300)
+				key := Key(m.Question[0], "")
+				c.InsertMessage(key, m, 0, "Primary")
+				c.Count(c.Hit(key, 1) != nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.Length != 4000 || stats.Hits != 4000 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, l := c.Dump(true); l != 4000 {
+		t.Errorf("dumped %d entries", l)
+	}
+}
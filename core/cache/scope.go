@@ -0,0 +1,144 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Responses with ECS are cached under the subnet of their scope prefix length as RFC 7871 section 7.3
+// describes, a response of scope 0 or without ECS is valid for every client and cached under the
+// question alone. scopes keeps the scope prefix lengths present for every question and address family,
+// so that lookups try only those.
+type scopes map[string]map[uint8]int
+
+func (s scopes) add(base string, scope uint8) {
+	if s[base] == nil {
+		s[base] = make(map[uint8]int)
+	}
+	s[base][scope]++
+}
+
+func (s scopes) remove(base string, scope uint8) {
+	if s[base][scope]--; s[base][scope] <= 0 {
+		delete(s[base], scope)
+	}
+	if len(s[base]) == 0 {
+		delete(s, base)
+	}
+}
+
+// longestFirst returns the scope prefix lengths of base which are not longer than limit, longest first
+func (s scopes) longestFirst(base string, limit uint8) []uint8 {
+	var ls []uint8
+	for scope := range s[base] {
+		if scope <= limit {
+			ls = append(ls, scope)
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i] > ls[j] })
+	return ls
+}
+
+func scopeBase(name string, qtype string, family int) string {
+	return fmt.Sprintf("%s %s %d", name, qtype, family)
+}
+
+// parseSubnet parses a subnet like "192.0.2.0/24", it returns a nil ip for other strings
+func parseSubnet(subnet string) (ip net.IP, prefix uint8, family int) {
+	i := strings.IndexByte(subnet, '/')
+	if i < 0 {
+		return nil, 0, 0
+	}
+	ip = net.ParseIP(subnet[:i])
+	n, err := strconv.ParseUint(subnet[i+1:], 10, 8)
+	if ip == nil || err != nil {
+		return nil, 0, 0
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, uint8(n), 1
+	}
+	return ip, uint8(n), 2
+}
+
+func maskSubnet(ip net.IP, scope uint8) string {
+	return ip.Mask(net.CIDRMask(int(scope), 8*len(ip))).String() + "/" + strconv.Itoa(int(scope))
+}
+
+// parseScopedKey returns the question part of a key, and its address family and scope prefix length
+// if it has a subnet.
+func parseScopedKey(key string) (base string, scope uint8, ok bool) {
+	fields := strings.Fields(key)
+	if len(fields) != 3 {
+		return "", 0, false
+	}
+	_, scope, family := parseSubnet(fields[2])
+	if family == 0 || scope == 0 {
+		return "", 0, false
+	}
+	return scopeBase(fields[0], fields[1], family), scope, true
+}
+
+// ScopedKey returns the key which m, the response to question q sent with the ECS subnet, is cached under.
+func (c *Cache) ScopedKey(q dns.Question, subnet string, m *dns.Msg) string {
+	if c == nil || c.redisClient != nil {
+		return Key(q, subnet)
+	}
+	ip, prefix, family := parseSubnet(subnet)
+	if ip == nil {
+		return Key(q, subnet)
+	}
+
+	var scope uint8
+	if o := m.IsEdns0(); o != nil {
+		for _, option := range o.Option {
+			if e, ok := option.(*dns.EDNS0_SUBNET); ok && int(e.Family) == family {
+				scope = e.SourceScope
+			}
+		}
+	}
+	// Scopes longer than the subnet sent cannot be told apart, they are cached under the subnet
+	if scope > prefix {
+		scope = prefix
+	}
+	if scope == 0 {
+		return Key(q, "")
+	}
+	return Key(q, maskSubnet(ip, scope))
+}
+
+// MatchKey returns the key of the local entry for question q sent with the ECS subnet whose scope is the
+// longest one containing the subnet, or the key of q and subnet if there is none.
+func (c *Cache) MatchKey(q dns.Question, subnet string) string {
+	key := Key(q, subnet)
+	if c == nil || c.redisClient != nil {
+		return key
+	}
+	ip, prefix, family := parseSubnet(subnet)
+	if ip == nil {
+		return key
+	}
+
+	// All entries of q are in the shard of key
+	sh := c.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	for _, scope := range sh.scopes.longestFirst(scopeBase(q.Name, strconv.Itoa(int(q.Qtype)), family), prefix) {
+		k := Key(q, maskSubnet(ip, scope))
+		if _, ok := sh.table[k]; ok {
+			return k
+		}
+	}
+	if global := Key(q, ""); sh.table[global] != nil {
+		return global
+	}
+	return key
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxShards is the number of shards of large caches
+	maxShards = 64
+	// minShardCapacity keeps small caches in few shards, so that eviction stays close to global LRU
+	minShardCapacity = 256
+)
+
+// shard is a part of the local table with its own lock, recency list and limits. Entries of the same
+// question are in the same shard whatever their ECS subnets are, so that their scopes are found together.
+type shard struct {
+	sync.RWMutex
+
+	capacity int
+	maxBytes int
+	bytes    int
+	table    map[string]*elem
+	recency  *list.List // keys of the entries, the most recently used first
+	scopes   scopes
+}
+
+func newShard(capacity int) *shard {
+	return &shard{capacity: capacity, table: make(map[string]*elem), recency: list.New(), scopes: make(scopes)}
+}
+
+// newShards divides capacity among a power of two shards
+func newShards(capacity int) []*shard {
+	n := 1
+	for n < maxShards && capacity/(2*n) >= minShardCapacity {
+		n *= 2
+	}
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = newShard(split(capacity, n, i))
+	}
+	return shards
+}
+
+// split returns the part i of total divided into n parts
+func split(total int, n int, i int) int {
+	part := total / n
+	if i < total%n {
+		part++
+	}
+	return part
+}
+
+// shard returns the shard of key, which is chosen by the question part of key
+func (c *Cache) shard(key string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	question := key
+	if i := strings.LastIndexByte(key, ' '); i >= 0 {
+		question = key[:i]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(question))
+	return c.shards[h.Sum32()&uint32(len(c.shards)-1)]
+}
+
+// get returns the entry of key, and marks it as the most recently used one and counts its hit if it
+// has not expired
+func (s *shard) get(key string) (*elem, bool) {
+	// The write lock is needed to move the entry in the recency list
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.table[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().Before(e.expiration) {
+		atomic.AddUint32(&e.hits, 1)
+		s.recency.MoveToFront(e.element)
+	}
+	return e, true
+}
+
+// peek returns the entry of key and leaves its recency alone
+func (s *shard) peek(key string) (*elem, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.table[key]
+	return e, ok
+}
+
+// set inserts or replaces the entry of key, and returns the number of entries evicted
+func (s *shard) set(key string, e *elem) int {
+	s.Lock()
+	defer s.Unlock()
+	e.size = e.msg.Len() + len(key)
+	if old, ok := s.table[key]; ok {
+		// Refreshed entries stay as popular as the ones they replace
+		e.hits = atomic.LoadUint32(&old.hits)
+		e.element = old.element
+		s.recency.MoveToFront(e.element)
+		s.bytes -= old.size
+	} else {
+		e.element = s.recency.PushFront(key)
+		if base, scope, ok := parseScopedKey(key); ok {
+			s.scopes.add(base, scope)
+		}
+	}
+	s.table[key] = e
+	s.bytes += e.size
+	return s.evict()
+}
+
+// delete removes the entry of key, it must be called under a write lock.
+func (s *shard) delete(key string) {
+	e, ok := s.table[key]
+	if !ok {
+		return
+	}
+	delete(s.table, key)
+	s.recency.Remove(e.element)
+	s.bytes -= e.size
+	if base, scope, ok := parseScopedKey(key); ok {
+		s.scopes.remove(base, scope)
+	}
+}
+
+// evict removes the least recently used entries until the shard is within its capacity and byte
+// budget, and returns the number of them. Must be called under a write lock.
+func (s *shard) evict() int {
+	evicted := 0
+	for len(s.table) > s.capacity || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		oldest := s.recency.Back()
+		if oldest == nil {
+			break
+		}
+		s.delete(oldest.Value.(string))
+		evicted++
+	}
+	return evicted
+}
@@ -2,21 +2,160 @@ package common
 
 import (
 	"net"
+	"strconv"
 
 	"github.com/miekg/dns"
 )
 
+// Policies of EDNS Client Subnet
+const (
+	// ECSAuto sends the subnet of the client, or of ExternalIP for clients with reserved addresses
+	ECSAuto = "auto"
+	// ECSManual sends the subnet of ExternalIP
+	ECSManual = "manual"
+	// ECSDisable adds no subnet, the option of the client is forwarded unchanged
+	ECSDisable = "disable"
+	// ECSPassthrough forwards the option of the client exactly, or sends the subnet of the client if it sent none
+	ECSPassthrough = "passthrough"
+	// ECSStrip removes the option of the client and sends no subnet
+	ECSStrip = "strip"
+)
+
+// Default source prefix lengths of subnets sent upstream
+const (
+	DefaultECSIPv4Prefix = 24
+	DefaultECSIPv6Prefix = 56
+)
+
 type EDNSClientSubnetType struct {
 	Policy     string `yaml:"policy" json:"policy"`
 	ExternalIP string `yaml:"externalIP" json:"externalIP"`
 	NoCookie   bool   `yaml:"noCookie"json:"noCookie"`
+	// IPv4Prefix and IPv6Prefix limit the source prefix length of the subnets sent by the auto and manual
+	// policies, longer subnets of clients are shortened to them. They are also the prefix lengths of the
+	// subnets of clients sent by the passthrough policy.
+	IPv4Prefix int `yaml:"ipv4Prefix" json:"ipv4Prefix"`
+	IPv6Prefix int `yaml:"ipv6Prefix" json:"ipv6Prefix"`
+	// ClientSubnets are sent by the auto and manual policies for groups of clients instead of their addresses
+	ClientSubnets []*ClientSubnet `yaml:"clientSubnets" json:"clientSubnets"`
+}
+
+// ClientSubnet is a fixed subnet sent for the clients in the IP networks Clients
+type ClientSubnet struct {
+	Clients []string `yaml:"clients" json:"clients"`
+	Subnet  string   `yaml:"subnet" json:"subnet"`
+
+	ClientSet *IPSet     `yaml:"-" json:"-"`
+	Network   *net.IPNet `yaml:"-" json:"-"`
+}
+
+// prefix returns the source prefix length of subnets of ip
+func (e *EDNSClientSubnetType) prefix(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		if e.IPv4Prefix <= 0 || e.IPv4Prefix > 8*net.IPv4len {
+			return DefaultECSIPv4Prefix
+		}
+		return uint8(e.IPv4Prefix)
+	}
+	if e.IPv6Prefix <= 0 || e.IPv6Prefix > 8*net.IPv6len {
+		return DefaultECSIPv6Prefix
+	}
+	return uint8(e.IPv6Prefix)
 }
 
-func SetEDNSClientSubnet(m *dns.Msg, ip string, isNoCookie bool) {
-	if ip == "" {
+// subnet returns the subnet sent for a query from client by the auto, manual and passthrough policies, or nil
+func (e *EDNSClientSubnetType) subnet(client net.IP) *dns.EDNS0_SUBNET {
+	// Groups of clients only apply to the auto and manual policies
+	if e.Policy != ECSPassthrough {
+		for _, cs := range e.ClientSubnets {
+			if cs.Network != nil && client != nil && cs.ClientSet != nil && cs.ClientSet.Contains(client, false, "") {
+				ones, _ := cs.Network.Mask.Size()
+				return NewEDNSClientSubnet(cs.Network.IP, uint8(ones))
+			}
+		}
+	}
+
+	var ip net.IP
+	external := net.ParseIP(e.ExternalIP)
+	switch e.Policy {
+	case ECSPassthrough:
+		if client != nil && !ReservedIPNetworkList.Contains(client, false, "") {
+			ip = client
+		}
+	case ECSAuto:
+		if client != nil && !ReservedIPNetworkList.Contains(client, false, "") {
+			ip = client
+		} else {
+			ip = external
+		}
+	case ECSManual:
+		if external != nil && !ReservedIPNetworkList.Contains(external, false, "") {
+			ip = external
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+	return NewEDNSClientSubnet(ip, e.prefix(ip))
+}
+
+// Apply sets the ECS option of m, which is sent upstream for a query from client, by the policy.
+func (e *EDNSClientSubnetType) Apply(m *dns.Msg, client net.IP) {
+	var own *dns.EDNS0_SUBNET
+	if o := m.IsEdns0(); o != nil {
+		own = IsEDNSClientSubnet(o)
+	}
+
+	switch e.Policy {
+	case ECSAuto, ECSManual:
+		// The subnet of the client is kept, but not more specific than the prefix length allows
+		if own != nil && !own.Address.IsUnspecified() {
+			if limit := e.prefix(own.Address); own.SourceNetmask > limit {
+				*own = *NewEDNSClientSubnet(own.Address, limit)
+			}
+			return
+		}
+	case ECSPassthrough:
+		if own != nil {
+			return
+		}
+	case ECSStrip:
+		if own != nil {
+			deleteEDNSClientSubnet(m.IsEdns0())
+		}
+		return
+	default:
+		return
+	}
+
+	nes := e.subnet(client)
+	if nes == nil {
 		return
 	}
+	SetEDNSClientSubnet(m, nes)
+	if e.NoCookie {
+		deleteCookie(m.IsEdns0())
+	}
+}
+
+// NewEDNSClientSubnet returns the ECS option of the subnet of ip with the source prefix length
+func NewEDNSClientSubnet(ip net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	nes := new(dns.EDNS0_SUBNET)
+	nes.Code = dns.EDNS0SUBNET
+	if ip4 := ip.To4(); ip4 != nil {
+		nes.Family = 1 // 1 for IPv4 source address, 2 for IPv6
+		nes.Address = ip4.Mask(net.CIDRMask(int(prefix), 8*net.IPv4len))
+	} else {
+		nes.Family = 2
+		nes.Address = ip.Mask(net.CIDRMask(int(prefix), 8*net.IPv6len))
+	}
+	nes.SourceNetmask = prefix
+	nes.SourceScope = 0
+	return nes
+}
 
+// SetEDNSClientSubnet replaces the ECS option of m with nes, adding an OPT record if m does not have one yet.
+func SetEDNSClientSubnet(m *dns.Msg, nes *dns.EDNS0_SUBNET) {
 	o := m.IsEdns0()
 	if o == nil {
 		o = new(dns.OPT)
@@ -25,36 +164,18 @@ func SetEDNSClientSubnet(m *dns.Msg, ip string, isNoCookie bool) {
 		o.Hdr.Rrtype = dns.TypeOPT
 		m.Extra = append(m.Extra, o)
 	}
+	deleteEDNSClientSubnet(o)
+	o.Option = append(o.Option, nes)
+}
 
-	es := IsEDNSClientSubnet(o)
-	if es == nil || es.Address.IsUnspecified() {
-		nes := new(dns.EDNS0_SUBNET)
-		nes.Code = dns.EDNS0SUBNET
-		nes.Address = net.ParseIP(ip)
-		if nes.Address.To4() != nil {
-			nes.Family = 1         // 1 for IPv4 source address, 2 for IPv6
-			nes.SourceNetmask = 24 // 24 for IPV4, 56 for IPv6
-		} else {
-			nes.Family = 2         // 1 for IPv4 source address, 2 for IPv6
-			nes.SourceNetmask = 56 // 24 for IPV4, 56 for IPv6
-		}
-		nes.SourceScope = 0
-		if es != nil && es.Address.IsUnspecified() {
-			var edns0 []dns.EDNS0
-			for _, s := range o.Option {
-				switch e := s.(type) {
-				case *dns.EDNS0_SUBNET:
-				default:
-					edns0 = append(edns0, e)
-				}
-			}
-			o.Option = edns0
-		}
-		o.Option = append(o.Option, nes)
-		if isNoCookie {
-			deleteCookie(o)
+func deleteEDNSClientSubnet(o *dns.OPT) {
+	var edns0 []dns.EDNS0
+	for _, s := range o.Option {
+		if _, ok := s.(*dns.EDNS0_SUBNET); !ok {
+			edns0 = append(edns0, s)
 		}
 	}
+	o.Option = edns0
 }
 
 func deleteCookie(o *dns.OPT) {
@@ -76,6 +197,18 @@ func IsEDNSClientSubnet(o *dns.OPT) *dns.EDNS0_SUBNET {
 	return nil
 }
 
+// GetEDNSClientSubnet returns the subnet of the ECS option of m like "192.0.2.0/24", or ""
+func GetEDNSClientSubnet(m *dns.Msg) string {
+	o := m.IsEdns0()
+	if o == nil {
+		return ""
+	}
+	if e := IsEDNSClientSubnet(o); e != nil {
+		return e.Address.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+	}
+	return ""
+}
+
 func GetEDNSClientSubnetIP(m *dns.Msg) string {
 	o := m.IsEdns0()
 	if o != nil {
@@ -88,3 +221,17 @@ func GetEDNSClientSubnetIP(m *dns.Msg) string {
 	}
 	return ""
 }
+
+// SetExtendedError attaches an Extended DNS Error (RFC 8914) option to m, adding
+// an OPT record if m does not have one yet.
+func SetExtendedError(m *dns.Msg, code uint16, text string) {
+	o := m.IsEdns0()
+	if o == nil {
+		o = new(dns.OPT)
+		o.SetUDPSize(4096)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		m.Extra = append(m.Extra, o)
+	}
+	o.Option = append(o.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNSClientSubnetType_Apply(t *testing.T) {
+	query := func(subnet string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		if subnet != "" {
+			ip, network, _ := net.ParseCIDR(subnet)
+			ones, _ := network.Mask.Size()
+			SetEDNSClientSubnet(m, NewEDNSClientSubnet(ip, uint8(ones)))
+		}
+		return m
+	}
+	_, office, _ := net.ParseCIDR("10.1.0.0/16")
+	_, fixed, _ := net.ParseCIDR("203.0.113.0/24")
+	groups := []*ClientSubnet{{ClientSet: NewIPSet([]*net.IPNet{office}), Network: fixed}}
+
+	for _, c := range []struct {
+		ecs    EDNSClientSubnetType
+		client string
+		own    string
+		want   string
+	}{
+		{EDNSClientSubnetType{Policy: ECSAuto}, "198.51.100.77", "", "198.51.100.0/24"},
+		{EDNSClientSubnetType{Policy: ECSAuto, IPv4Prefix: 20}, "198.51.100.77", "", "198.51.96.0/20"},
+		{EDNSClientSubnetType{Policy: ECSAuto, IPv6Prefix: 48}, "2001:db8:1:2::1", "", "2001:db8:1::/48"},
+		{EDNSClientSubnetType{Policy: ECSAuto, IPv4Prefix: 20}, "198.51.100.77", "192.0.2.0/24", "192.0.0.0/20"},
+		{EDNSClientSubnetType{Policy: ECSAuto, ExternalIP: "192.0.2.1"}, "10.1.2.3", "", "192.0.2.0/24"},
+		{EDNSClientSubnetType{Policy: ECSAuto, ClientSubnets: groups}, "10.1.2.3", "", "203.0.113.0/24"},
+		{EDNSClientSubnetType{Policy: ECSManual, ExternalIP: "192.0.2.1"}, "198.51.100.77", "", "192.0.2.0/24"},
+		{EDNSClientSubnetType{Policy: ECSPassthrough}, "198.51.100.77", "", "198.51.100.0/24"},
+		{EDNSClientSubnetType{Policy: ECSPassthrough}, "10.1.2.3", "", ""},
+		{EDNSClientSubnetType{Policy: ECSPassthrough, IPv4Prefix: 20}, "198.51.100.77", "192.0.2.128/25", "192.0.2.128/25"},
+		{EDNSClientSubnetType{Policy: ECSStrip}, "198.51.100.77", "192.0.2.0/24", ""},
+		{EDNSClientSubnetType{Policy: ECSDisable}, "198.51.100.77", "", ""},
+		{EDNSClientSubnetType{Policy: ECSDisable}, "198.51.100.77", "192.0.2.128/25", "192.0.2.128/25"},
+	} {
+		m := query(c.own)
+		c.ecs.Apply(m, net.ParseIP(c.client))
+		if got := GetEDNSClientSubnet(m); got != c.want {
+			t.Errorf("policy %s for %s with %q: got subnet %q, want %q", c.ecs.Policy, c.client, c.own, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import "github.com/miekg/dns"
+
+// Fallback actions
+const (
+	FallbackReturn = "return" // return the response as-is
+	FallbackRetry  = "retry"  // query the other DNS group
+	FallbackStale  = "stale"  // answer from stale cache if possible, otherwise return as-is
+)
+
+// FallbackPolicy decides what to do with the response of the chosen DNS group by its rcode.
+type FallbackPolicy struct {
+	Timeout  string `yaml:"timeout" json:"timeout"`
+	ServFail string `yaml:"servfail" json:"servfail"`
+	Refused  string `yaml:"refused" json:"refused"`
+	NXDomain string `yaml:"nxdomain" json:"nxdomain"`
+	NoData   string `yaml:"nodata" json:"nodata"`
+}
+
+// Action returns the fallback action for m, a nil m means the upstreams failed or timed out.
+func (p *FallbackPolicy) Action(m *dns.Msg) string {
+	if p == nil {
+		return FallbackReturn
+	}
+
+	var action string
+	switch {
+	case m == nil:
+		action = p.Timeout
+	case m.Rcode == dns.RcodeServerFailure:
+		action = p.ServFail
+	case m.Rcode == dns.RcodeRefused:
+		action = p.Refused
+	case m.Rcode == dns.RcodeNameError:
+		action = p.NXDomain
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0:
+		action = p.NoData
+	}
+
+	switch action {
+	case FallbackRetry, FallbackStale:
+		return action
+	default:
+		return FallbackReturn
+	}
+}
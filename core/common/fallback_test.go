@@ -0,0 +1,43 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFallbackPolicy_Action(t *testing.T) {
+	p := &FallbackPolicy{Timeout: FallbackStale, ServFail: FallbackRetry, NoData: FallbackRetry, NXDomain: "unknown"}
+
+	reply := func(rcode int, answer bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Rcode = rcode
+		if answer {
+			rr, _ := dns.NewRR("example.com. IN A 1.2.3.4")
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+
+	for _, tt := range []struct {
+		m      *dns.Msg
+		action string
+	}{
+		{nil, FallbackStale},
+		{reply(dns.RcodeServerFailure, false), FallbackRetry},
+		{reply(dns.RcodeRefused, false), FallbackReturn},
+		{reply(dns.RcodeNameError, false), FallbackReturn},
+		{reply(dns.RcodeSuccess, false), FallbackRetry},
+		{reply(dns.RcodeSuccess, true), FallbackReturn},
+	} {
+		if action := p.Action(tt.m); action != tt.action {
+			t.Errorf("got %s, want %s for %v", action, tt.action, tt.m)
+		}
+	}
+
+	var nilPolicy *FallbackPolicy
+	if nilPolicy.Action(nil) != FallbackReturn {
+		t.Error("nil policy should return as-is")
+	}
+}
@@ -28,6 +28,11 @@ type IPSet struct {
 }
 
 func (s ipRanges) contains(ip net.IP) bool {
+	return s.find(ip) != nil
+}
+
+// find returns the range which contains ip, or nil.
+func (s ipRanges) find(ip net.IP) *ipRange {
 	l, r := 0, len(s)-1
 	for l <= r {
 		mid := (l + r) / 2
@@ -37,7 +42,31 @@ func (s ipRanges) contains(ip net.IP) bool {
 			l = mid + 1
 		}
 	}
-	return r >= 0 && bytes.Compare(s[r].start, ip) <= 0 && bytes.Compare(ip, s[r].end) <= 0
+	if r >= 0 && bytes.Compare(s[r].start, ip) <= 0 && bytes.Compare(ip, s[r].end) <= 0 {
+		return s[r]
+	}
+	return nil
+}
+
+func (r *ipRange) String() string {
+	return r.start.String() + "-" + r.end.String()
+}
+
+// Range returns the (merged) range of the set which contains ip, formatted as "start-end".
+func (ipSet *IPSet) Range(ip net.IP) (string, bool) {
+	if ipSet == nil {
+		return "", false
+	}
+	var r *ipRange
+	if ipv4 := ip.To4(); ipv4 != nil {
+		r = ipSet.ipv4.find(ipv4)
+	} else if ipv6 := ip.To16(); ipv6 != nil {
+		r = ipSet.ipv6.find(ipv6)
+	}
+	if r == nil {
+		return "", false
+	}
+	return r.String(), true
 }
 
 func (ipSet *IPSet) Contains(ip net.IP, isLog bool, name string) bool {
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package common
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	inAddrArpa = ".in-addr.arpa."
+	ip6Arpa    = ".ip6.arpa."
+)
+
+// specialUseNames are the names which must not be sent to public resolvers, they are the locally
+// served reverse zones of RFC 6303 and RFC 7793, and the special-use names of RFC 6761 and RFC 6762.
+var specialUseNames = func() map[string]bool {
+	names := map[string]bool{
+		"localhost.": true,
+		"invalid.":   true,
+		"local.":     true,
+
+		"0.in-addr.arpa.":               true,
+		"10.in-addr.arpa.":              true,
+		"127.in-addr.arpa.":             true,
+		"254.169.in-addr.arpa.":         true,
+		"168.192.in-addr.arpa.":         true,
+		"2.0.192.in-addr.arpa.":         true,
+		"100.51.198.in-addr.arpa.":      true,
+		"113.0.203.in-addr.arpa.":       true,
+		"255.255.255.255.in-addr.arpa.": true,
+
+		"d.f.ip6.arpa.":                               true,
+		"8.e.f.ip6.arpa.":                             true,
+		"9.e.f.ip6.arpa.":                             true,
+		"a.e.f.ip6.arpa.":                             true,
+		"b.e.f.ip6.arpa.":                             true,
+		"8.b.d.0.1.0.0.2.ip6.arpa.":                   true,
+		strings.Repeat("0.", 32) + "ip6.arpa.":        true,
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa.": true,
+	}
+	for i := 16; i <= 31; i++ {
+		names[strconv.Itoa(i)+".172.in-addr.arpa."] = true
+	}
+	for i := 64; i <= 127; i++ {
+		names[strconv.Itoa(i)+".100.in-addr.arpa."] = true
+	}
+	return names
+}()
+
+// IsSpecialUseName reports whether name is in a private reverse zone or a special-use domain.
+func IsSpecialUseName(name string) bool {
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if specialUseNames[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReverseName returns the IP address of a full in-addr.arpa or ip6.arpa name, or nil.
+func ParseReverseName(name string) net.IP {
+	name = dns.CanonicalName(name)
+	switch {
+	case strings.HasSuffix(name, inAddrArpa):
+		labels := strings.Split(strings.TrimSuffix(name, inAddrArpa), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, s := range labels {
+			v, err := strconv.ParseUint(s, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(v)
+		}
+		return ip
+	case strings.HasSuffix(name, ip6Arpa):
+		nibbles := strings.Split(strings.TrimSuffix(name, ip6Arpa), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, s := range nibbles {
+			v, err := strconv.ParseUint(s, 16, 4)
+			if err != nil || len(s) != 1 {
+				return nil
+			}
+			// Nibbles are in reverse order, the last one is the high nibble of the first byte
+			n := 2*net.IPv6len - 1 - i
+			if n%2 == 0 {
+				ip[n/2] |= byte(v) << 4
+			} else {
+				ip[n/2] |= byte(v)
+			}
+		}
+		return ip
+	}
+	return nil
+}
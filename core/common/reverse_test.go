@@ -0,0 +1,39 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseReverseName(t *testing.T) {
+	for name, want := range map[string]string{
+		"4.3.2.1.in-addr.arpa.": "1.2.3.4",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.ip6.arpa.": "2001:db8::1",
+	} {
+		if ip := ParseReverseName(name); !ip.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: parsed %s, want %s", name, ip, want)
+		}
+	}
+	for _, name := range []string{"3.2.1.in-addr.arpa.", "256.3.2.1.in-addr.arpa.", "1.0.ip6.arpa.", "www.example.com."} {
+		if ip := ParseReverseName(name); ip != nil {
+			t.Errorf("%s: parsed %s, want nil", name, ip)
+		}
+	}
+}
+
+func TestIsSpecialUseName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"1.1.168.192.in-addr.arpa.": true,
+		"20.172.in-addr.arpa.":      true,
+		"1.32.172.in-addr.arpa.":    false,
+		"8.8.8.8.in-addr.arpa.":     false,
+		"printer.local.":            true,
+		"LOCALHOST.":                true,
+		"example.invalid.":          true,
+		"localhost.example.com.":    false,
+	} {
+		if got := IsSpecialUseName(name); got != want {
+			t.Errorf("%s: got %t, want %t", name, got, want)
+		}
+	}
+}
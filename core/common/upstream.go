@@ -14,3 +14,9 @@ type DNSUpstream struct {
 		IdleTimeout     int  `yaml:"idleTimeout" json:"idleTimeout"`
 	} `yaml:"tcpPoolConfig" json:"tcpPoolConfig"`
 }
+
+// ForwardZone is a list of domains whose names, including the domains themselves, are sent only to DNS
+type ForwardZone struct {
+	Domains []string       `yaml:"domains" json:"domains"`
+	DNS     []*DNSUpstream `yaml:"dns" json:"dns"`
+}
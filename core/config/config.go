@@ -6,41 +6,54 @@ package config
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/dnssec"
 	"github.com/shawn1m/overture/core/finder"
 	finderfull "github.com/shawn1m/overture/core/finder/full"
 	finderregex "github.com/shawn1m/overture/core/finder/regex"
+	findersuffix "github.com/shawn1m/overture/core/finder/suffix"
 	"github.com/shawn1m/overture/core/hosts"
+	"github.com/shawn1m/overture/core/leases"
 	"github.com/shawn1m/overture/core/matcher"
 	matcherfinal "github.com/shawn1m/overture/core/matcher/final"
 	matcherfull "github.com/shawn1m/overture/core/matcher/full"
 	matchermix "github.com/shawn1m/overture/core/matcher/mix"
 	matcherregex "github.com/shawn1m/overture/core/matcher/regex"
 	matchersuffix "github.com/shawn1m/overture/core/matcher/suffix"
+	"github.com/shawn1m/overture/core/policy"
+	"github.com/shawn1m/overture/core/records"
+	"github.com/shawn1m/overture/core/zone"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	FilePath                    string                `yaml:"-" json:"-"`
-	BindAddress                 string                `yaml:"bindAddress" json:"bindAddress"`
-	DebugHTTPAddress            string                `yaml:"debugHTTPAddress" json:"debugHTTPAddress"`
-	DohEnabled                  bool                  `yaml:"dohEnabled" json:"dohEnabled"`
-	PrimaryDNS                  []*common.DNSUpstream `yaml:"primaryDNS" json:"primaryDNS"`
-	AlternativeDNS              []*common.DNSUpstream `yaml:"alternativeDNS" json:"alternativeDNS"`
-	OnlyPrimaryDNS              bool                  `yaml:"onlyPrimaryDNS" json:"onlyPrimaryDNS"`
-	IPv6UseAlternativeDNS       bool                  `yaml:"ipv6UseAlternativeDNS" json:"ipv6UseAlternativeDNS"`
-	AlternativeDNSConcurrent    bool                  `yaml:"alternativeDNSConcurrent" json:"alternativeDNSConcurrent"`
-	WhenPrimaryDNSAnswerNoneUse string                `yaml:"whenPrimaryDNSAnswerNoneUse" json:"whenPrimaryDNSAnswerNoneUse"`
+	FilePath                    string                 `yaml:"-" json:"-"`
+	BindAddress                 string                 `yaml:"bindAddress" json:"bindAddress"`
+	DebugHTTPAddress            string                 `yaml:"debugHTTPAddress" json:"debugHTTPAddress"`
+	DohEnabled                  bool                   `yaml:"dohEnabled" json:"dohEnabled"`
+	PrimaryDNS                  []*common.DNSUpstream  `yaml:"primaryDNS" json:"primaryDNS"`
+	AlternativeDNS              []*common.DNSUpstream  `yaml:"alternativeDNS" json:"alternativeDNS"`
+	OnlyPrimaryDNS              bool                   `yaml:"onlyPrimaryDNS" json:"onlyPrimaryDNS"`
+	ForwardZones                []*common.ForwardZone  `yaml:"forwardZones" json:"forwardZones"`
+	IPv6UseAlternativeDNS       bool                   `yaml:"ipv6UseAlternativeDNS" json:"ipv6UseAlternativeDNS"`
+	AlternativeDNSConcurrent    bool                   `yaml:"alternativeDNSConcurrent" json:"alternativeDNSConcurrent"`
+	WhenPrimaryDNSAnswerNoneUse string                 `yaml:"whenPrimaryDNSAnswerNoneUse" json:"whenPrimaryDNSAnswerNoneUse"` // Deprecated: use Fallback
+	Fallback                    *common.FallbackPolicy `yaml:"fallback" json:"fallback"`
+	QueryTimeout                int                    `yaml:"queryTimeout" json:"queryTimeout"`
 	IPNetworkFile               struct {
 		Primary     string `yaml:"primary" json:"primary"`
 		Alternative string `yaml:"alternative" json:"alternative"`
@@ -53,15 +66,77 @@ type Config struct {
 		Matcher            string `yaml:"matcher" json:"matcher"`
 	} `yaml:"domainFile" json:"domainFile"`
 	HostsFile struct {
-		HostsFile string `yaml:"hostsFile" json:"hostsFile"`
-		Finder    string `yaml:"finder" json:"finder"`
+		HostsFile      string   `yaml:"hostsFile" json:"hostsFile"`
+		Sources        []string `yaml:"sources" json:"sources"`
+		ReloadInterval int      `yaml:"reloadInterval" json:"reloadInterval"`
+		TTL            int      `yaml:"ttl" json:"ttl"`
+		Finder         string   `yaml:"finder" json:"finder"`
 	} `yaml:"hostsFile" json:"hostsFile"`
+	LocalRecords struct {
+		File    string   `yaml:"file" json:"file"`
+		Records []string `yaml:"records" json:"records"`
+	} `yaml:"localRecords" json:"localRecords"`
+	DHCPLeases struct {
+		Domain string `yaml:"domain" json:"domain"`
+		Files  []struct {
+			Path   string `yaml:"path" json:"path"`
+			Format string `yaml:"format" json:"format"`
+		} `yaml:"files" json:"files"`
+		ReloadInterval int `yaml:"reloadInterval" json:"reloadInterval"`
+		TTL            int `yaml:"ttl" json:"ttl"`
+	} `yaml:"dhcpLeases" json:"dhcpLeases"`
+	LocalSpecialUseNames         bool     `yaml:"localSpecialUseNames" json:"localSpecialUseNames"`
 	MinimumTTL                   int      `yaml:"minimumTTL" json:"minimumTTL"`
 	DomainTTLFile                string   `yaml:"domainTTLFile" json:"domainTTLFile"`
 	CacheSize                    int      `yaml:"cacheSize" json:"cacheSize"`
+	CacheMaxBytes                int      `yaml:"cacheMaxBytes" json:"cacheMaxBytes"`
+	CacheMaxStale                int      `yaml:"cacheMaxStale" json:"cacheMaxStale"`
+	CacheTTLJitter               float64  `yaml:"cacheTTLJitter" json:"cacheTTLJitter"`
 	CacheRedisUrl                string   `yaml:"cacheRedisUrl" json:"cacheRedisUrl"`
 	CacheRedisConnectionPoolSize int      `yaml:"cacheRedisConnectionPoolSize" json:"cacheRedisConnectionPoolSize"`
 	RejectQType                  []uint16 `yaml:"rejectQType" json:"rejectQType"`
+	CachePrefetch                struct {
+		MinHits   int     `yaml:"minHits" json:"minHits"`
+		Threshold float64 `yaml:"threshold" json:"threshold"`
+	} `yaml:"cachePrefetch" json:"cachePrefetch"`
+	AAAAPolicy []struct {
+		Action     string   `yaml:"action" json:"action"`
+		DomainFile string   `yaml:"domainFile" json:"domainFile"`
+		Matcher    string   `yaml:"matcher" json:"matcher"`
+		Clients    []string `yaml:"clients" json:"clients"`
+	} `yaml:"aaaaPolicy" json:"aaaaPolicy"`
+	CacheWarmUp struct {
+		File         string `yaml:"file" json:"file"`
+		SnapshotFile string `yaml:"snapshotFile" json:"snapshotFile"`
+		TopN         int    `yaml:"topN" json:"topN"`
+	} `yaml:"cacheWarmUp" json:"cacheWarmUp"`
+	DNSSEC struct {
+		Primary         bool   `yaml:"primary" json:"primary"`
+		Alternative     bool   `yaml:"alternative" json:"alternative"`
+		TrustAnchorFile string `yaml:"trustAnchorFile" json:"trustAnchorFile"`
+	} `yaml:"dnssec" json:"dnssec"`
+	DNS64 struct {
+		Prefix  string   `yaml:"prefix" json:"prefix"`
+		Clients []string `yaml:"clients" json:"clients"`
+	} `yaml:"dns64" json:"dns64"`
+	Zones []struct {
+		Origin        string   `yaml:"origin" json:"origin"`
+		File          string   `yaml:"file" json:"file"`
+		Journal       string   `yaml:"journal" json:"journal"`
+		AllowUpdate   []string `yaml:"allowUpdate" json:"allowUpdate"`
+		AllowTransfer []string `yaml:"allowTransfer" json:"allowTransfer"`
+	} `yaml:"zones" json:"zones"`
+	SecondaryZones []struct {
+		Origin        string   `yaml:"origin" json:"origin"`
+		Primary       string   `yaml:"primary" json:"primary"`
+		File          string   `yaml:"file" json:"file"`
+		TSIGKey       string   `yaml:"tsigKey" json:"tsigKey"`
+		AllowTransfer []string `yaml:"allowTransfer" json:"allowTransfer"`
+	} `yaml:"secondaryZones" json:"secondaryZones"`
+	TSIGKeys []struct {
+		Name   string `yaml:"name" json:"name"`
+		Secret string `yaml:"secret" json:"secret"`
+	} `yaml:"tsigKeys" json:"tsigKeys"`
 
 	DomainTTLMap            map[string]uint32 `yaml:"-" json:"-"`
 	DomainPrimaryList       matcher.Matcher   `yaml:"-" json:"-"`
@@ -69,7 +144,15 @@ type Config struct {
 	IPNetworkPrimarySet     *common.IPSet     `yaml:"-" json:"-"`
 	IPNetworkAlternativeSet *common.IPSet     `yaml:"-" json:"-"`
 	Hosts                   *hosts.Hosts      `yaml:"-" json:"-"`
+	Leases                  *leases.Leases    `yaml:"-" json:"-"`
+	Records                 *records.Records  `yaml:"-" json:"-"`
 	Cache                   *cache.Cache      `yaml:"-" json:"-"`
+	WarmUpQuestions         []dns.Question    `yaml:"-" json:"-"`
+	AAAAPolicyList          policy.AAAAList   `yaml:"-" json:"-"`
+	TrustAnchors            []*dns.DS         `yaml:"-" json:"-"`
+	DNS64Policy             *policy.DNS64     `yaml:"-" json:"-"`
+	LocalZones              *zone.Zones       `yaml:"-" json:"-"`
+	TSIGSecrets             map[string]string `yaml:"-" json:"-"`
 }
 
 // New config with config file and do some other initiate works
@@ -79,34 +162,131 @@ func NewConfig(configFile string) *Config {
 
 	config.DomainTTLMap = getDomainTTLMap(config.DomainTTLFile)
 
+	config.Fallback = getFallbackPolicy(config.Fallback, config.WhenPrimaryDNSAnswerNoneUse)
+	if err := initEDNSClientSubnets(config); err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+
 	config.DomainPrimaryList = initDomainMatcher(config.DomainFile.Primary, config.DomainFile.PrimaryMatcher, config.DomainFile.Matcher)
 	config.DomainAlternativeList = initDomainMatcher(config.DomainFile.Alternative, config.DomainFile.AlternativeMatcher, config.DomainFile.Matcher)
 
 	config.IPNetworkPrimarySet = getIPNetworkSet(config.IPNetworkFile.Primary)
 	config.IPNetworkAlternativeSet = getIPNetworkSet(config.IPNetworkFile.Alternative)
 
+	config.AAAAPolicyList = getAAAAPolicyList(config)
+	config.DNS64Policy = getDNS64Policy(config)
+
+	if config.DNSSEC.Primary || config.DNSSEC.Alternative {
+		config.TrustAnchors = getTrustAnchors(config.DNSSEC.TrustAnchorFile)
+		log.Infof("DNSSEC validation is enabled for primary DNS: %t, alternative DNS: %t", config.DNSSEC.Primary, config.DNSSEC.Alternative)
+	}
+
+	if config.QueryTimeout > 0 {
+		log.Infof("Query timeout has been set to %d seconds", config.QueryTimeout)
+	}
+
+	if config.LocalSpecialUseNames {
+		log.Info("Private reverse zones and special-use names will be answered with NXDOMAIN locally")
+	}
+
 	if config.MinimumTTL > 0 {
 		log.Infof("Minimum TTL has been set to %d", config.MinimumTTL)
 	} else {
 		log.Info("Minimum TTL is disabled")
 	}
 
-	config.Cache = cache.New(config.CacheSize, config.CacheRedisUrl, config.CacheRedisConnectionPoolSize)
+	config.Cache = cache.New(config.CacheSize, config.CacheRedisUrl, config.CacheRedisConnectionPoolSize, config.CacheMaxStale)
 	if config.CacheSize > 0 {
 		log.Infof("CacheSize is %d", config.CacheSize)
+		if config.CacheMaxStale > 0 {
+			log.Infof("Stale cache will be served for %d seconds after expiration", config.CacheMaxStale)
+		}
+		config.Cache.SetPrefetch(config.CachePrefetch.MinHits, config.CachePrefetch.Threshold)
+		config.Cache.SetTTLJitter(config.CacheTTLJitter)
+		if config.CacheMaxBytes > 0 {
+			log.Infof("Cache is limited to %d bytes", config.CacheMaxBytes)
+			config.Cache.SetMaxBytes(config.CacheMaxBytes)
+		}
+		if config.CachePrefetch.MinHits > 0 {
+			log.Infof("Cache prefetch is enabled for records hit at least %d times", config.CachePrefetch.MinHits)
+		}
 	} else {
 		log.Info("Cache is disabled")
 	}
 
-	h, err := hosts.New(config.HostsFile.HostsFile, getFinder(config.HostsFile.Finder))
+	config.WarmUpQuestions = getWarmUpQuestions(config.CacheWarmUp.File)
+
+	config.TSIGSecrets = getTSIGSecrets(config)
+	config.LocalZones = getLocalZones(config)
+
+	config.Hosts = getHosts(config)
+	config.Records = getLocalRecords(config)
+	config.Leases = getLeases(config)
+
+	return config
+}
+
+func getLeases(config *Config) *leases.Leases {
+	if len(config.DHCPLeases.Files) == 0 {
+		return nil
+	}
+	if config.DHCPLeases.Domain == "" {
+		log.Error("DHCP leases are not loaded without a local domain")
+		return nil
+	}
+
+	var files []*leases.File
+	var paths []string
+	for _, f := range config.DHCPLeases.Files {
+		files = append(files, &leases.File{Path: f.Path, Format: f.Format})
+		paths = append(paths, f.Path)
+	}
+	interval := time.Duration(config.DHCPLeases.ReloadInterval) * time.Second
+	l := leases.Load(files, config.DHCPLeases.Domain, interval)
+	if config.DHCPLeases.TTL > 0 {
+		l.TTL = uint32(config.DHCPLeases.TTL)
+	}
+	log.Infof("DHCP leases of %s have been loaded from %s", l.Domain, strings.Join(paths, ", "))
+	if interval > 0 {
+		log.Infof("DHCP leases will be reloaded on change, checked every %s", interval)
+	}
+	return l
+}
+
+func getLocalRecords(config *Config) *records.Records {
+	if config.LocalRecords.File == "" && len(config.LocalRecords.Records) == 0 {
+		return nil
+	}
+	rs, err := records.Load(config.LocalRecords.File, config.LocalRecords.Records)
 	if err != nil {
-		log.Warnf("Failed to load hosts file: %s", err)
-	} else {
-		config.Hosts = h
-		log.Info("Hosts file has been loaded successfully")
+		log.Errorf("Failed to load local records: %s", err)
+		return nil
 	}
+	log.Infof("Local records have been loaded with %d records", rs.Len())
+	return rs
+}
 
-	return config
+func getHosts(config *Config) *hosts.Hosts {
+	var sources []string
+	if config.HostsFile.HostsFile != "" {
+		sources = append(sources, config.HostsFile.HostsFile)
+	}
+	sources = append(sources, config.HostsFile.Sources...)
+	if len(sources) == 0 {
+		return nil
+	}
+
+	finderName := getFinder(config.HostsFile.Finder).Name()
+	interval := time.Duration(config.HostsFile.ReloadInterval) * time.Second
+	h := hosts.Load(sources, func() finder.Finder { return getFinder(finderName) }, interval)
+	if config.HostsFile.TTL > 0 {
+		h.TTL = uint32(config.HostsFile.TTL)
+	}
+	log.Infof("Hosts have been loaded from %s", strings.Join(sources, ", "))
+	if interval > 0 {
+		log.Infof("Hosts will be reloaded on change, checked every %s", interval)
+	}
+	return h
 }
 
 func parseConfigFile(path string) *Config {
@@ -131,6 +311,136 @@ func parseConfigFile(path string) *Config {
 	return config
 }
 
+// getFallbackPolicy fills the unset fallback actions, whenPrimaryDNSAnswerNoneUse is still respected
+// for answerless responses of primary DNS by the IP network dispatch for compatibility.
+func getFallbackPolicy(p *common.FallbackPolicy, whenPrimaryDNSAnswerNoneUse string) *common.FallbackPolicy {
+	if p == nil {
+		p = new(common.FallbackPolicy)
+	}
+	if whenPrimaryDNSAnswerNoneUse != "" {
+		log.Warn("whenPrimaryDNSAnswerNoneUse is deprecated, please use fallback instead")
+	}
+	for _, action := range []*string{&p.Timeout, &p.ServFail} {
+		if *action == "" {
+			*action = common.FallbackStale
+		}
+	}
+	for _, action := range []*string{&p.Timeout, &p.ServFail, &p.Refused, &p.NXDomain, &p.NoData} {
+		switch *action {
+		case common.FallbackReturn, common.FallbackRetry, common.FallbackStale, "":
+		default:
+			log.Warnf("Fallback action %s does not exist, using %s as default", *action, common.FallbackReturn)
+			*action = common.FallbackReturn
+		}
+	}
+	return p
+}
+
+// initEDNSClientSubnets checks the ECS policies of all upstreams and parses their client subnets, an
+// empty policy is disable.
+func initEDNSClientSubnets(config *Config) error {
+	upstreams := append(append([]*common.DNSUpstream(nil), config.PrimaryDNS...), config.AlternativeDNS...)
+	for _, fz := range config.ForwardZones {
+		upstreams = append(upstreams, fz.DNS...)
+	}
+	for _, u := range upstreams {
+		ecs := u.EDNSClientSubnet
+		if ecs == nil {
+			continue
+		}
+		switch ecs.Policy {
+		case "":
+			ecs.Policy = common.ECSDisable
+		case common.ECSAuto, common.ECSManual, common.ECSDisable, common.ECSPassthrough, common.ECSStrip:
+		default:
+			return fmt.Errorf("EDNS client subnet policy %s of %s does not exist", ecs.Policy, u.Name)
+		}
+		if ecs.IPv4Prefix < 0 || ecs.IPv4Prefix > 32 {
+			log.Warnf("EDNS client subnet IPv4 prefix length %d of %s is out of range, using /%d as default", ecs.IPv4Prefix, u.Name, common.DefaultECSIPv4Prefix)
+			ecs.IPv4Prefix = 0
+		}
+		if ecs.IPv6Prefix < 0 || ecs.IPv6Prefix > 128 {
+			log.Warnf("EDNS client subnet IPv6 prefix length %d of %s is out of range, using /%d as default", ecs.IPv6Prefix, u.Name, common.DefaultECSIPv6Prefix)
+			ecs.IPv6Prefix = 0
+		}
+
+		var subnets []*common.ClientSubnet
+		for _, cs := range ecs.ClientSubnets {
+			_, network, err := net.ParseCIDR(cs.Subnet)
+			if err != nil {
+				log.Errorf("Invalid EDNS client subnet %s of %s: %s", cs.Subnet, u.Name, err)
+				continue
+			}
+			cs.Network = network
+			cs.ClientSet = getIPNetworkSetFromCIDRs(cs.Clients)
+			subnets = append(subnets, cs)
+		}
+		ecs.ClientSubnets = subnets
+	}
+	return nil
+}
+
+func getAAAAPolicyList(config *Config) policy.AAAAList {
+	var l policy.AAAAList
+	for _, p := range config.AAAAPolicy {
+		switch p.Action {
+		case policy.AAAAForward, policy.AAAANoData, policy.AAAAPreferIPv4, policy.AAAAStripHint:
+		default:
+			log.Warnf("AAAA policy action %s does not exist, ignoring", p.Action)
+			continue
+		}
+
+		aaaa := &policy.AAAA{Action: p.Action}
+		if p.DomainFile != "" {
+			aaaa.Domains = initDomainMatcher(p.DomainFile, p.Matcher, config.DomainFile.Matcher)
+			if aaaa.Domains == nil {
+				continue
+			}
+		}
+		if len(p.Clients) > 0 {
+			aaaa.Clients = getIPNetworkSetFromCIDRs(p.Clients)
+			if aaaa.Clients == nil {
+				continue
+			}
+		}
+		l = append(l, aaaa)
+	}
+	if len(l) > 0 {
+		log.Infof("%d AAAA policies have been loaded", len(l))
+	}
+	return l
+}
+
+func getDNS64Policy(config *Config) *policy.DNS64 {
+	if config.DNS64.Prefix == "" {
+		return nil
+	}
+	var clients *common.IPSet
+	if len(config.DNS64.Clients) > 0 {
+		clients = getIPNetworkSetFromCIDRs(config.DNS64.Clients)
+	}
+	p, err := policy.NewDNS64(config.DNS64.Prefix, clients)
+	if err != nil {
+		log.Errorf("Invalid DNS64 prefix %s: %s", config.DNS64.Prefix, err)
+		return nil
+	}
+	log.Infof("DNS64 is enabled with prefix %s", p.Prefix)
+	return p
+}
+
+func getIPNetworkSetFromCIDRs(cidrs []string) *common.IPSet {
+	var ipNetList []*net.IPNet
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			log.Errorf("Error parsing IP network CIDR %s: %s", c, err)
+			continue
+		}
+		ipNetList = append(ipNetList, ipNet)
+	}
+	return common.NewIPSet(ipNetList)
+}
+
 func getDomainTTLMap(file string) map[string]uint32 {
 	if file == "" {
 		return map[string]uint32{}
@@ -197,6 +507,118 @@ func getDomainTTLMap(file string) map[string]uint32 {
 	return dtl
 }
 
+func getLocalZones(config *Config) *zone.Zones {
+	if len(config.Zones) == 0 && len(config.SecondaryZones) == 0 {
+		return nil
+	}
+	zs := zone.NewZones()
+	for _, c := range config.Zones {
+		z, err := zone.Load(c.Origin, c.File)
+		if err != nil {
+			log.Errorf("Failed to load zone %s from %s: %s", c.Origin, c.File, err)
+			continue
+		}
+		z.AllowUpdate = c.AllowUpdate
+		if len(c.AllowTransfer) > 0 {
+			z.AllowTransfer = getIPNetworkSetFromCIDRs(c.AllowTransfer)
+		}
+		if c.Journal != "" {
+			z.Journal = c.Journal
+			if err := z.ReplayJournal(); err != nil {
+				log.Errorf("Failed to replay journal of zone %s: %s", z.Origin, err)
+				continue
+			}
+		}
+		zs.Add(z)
+		log.Infof("Zone %s has been loaded with %d records", z.Origin, z.Len())
+		if len(z.AllowUpdate) > 0 {
+			log.Infof("Zone %s accepts dynamic update signed by %s", z.Origin, strings.Join(z.AllowUpdate, ", "))
+		}
+	}
+	for _, c := range config.SecondaryZones {
+		s := zone.NewSecondary(c.Origin, c.Primary)
+		s.File = c.File
+		if c.TSIGKey != "" {
+			secret, ok := config.TSIGSecrets[dns.CanonicalName(c.TSIGKey)]
+			if !ok {
+				log.Errorf("Unknown TSIG key %s of secondary zone %s", c.TSIGKey, c.Origin)
+				continue
+			}
+			s.TSIGKey, s.TSIGSecret = c.TSIGKey, secret
+		}
+		if len(c.AllowTransfer) > 0 {
+			s.AllowTransfer = getIPNetworkSetFromCIDRs(c.AllowTransfer)
+		}
+		zs.AddSecondary(s)
+		log.Infof("Zone %s is a secondary zone of %s", s.Origin, s.Primary)
+	}
+	return zs
+}
+
+func getTSIGSecrets(config *Config) map[string]string {
+	if len(config.TSIGKeys) == 0 {
+		return nil
+	}
+	secrets := make(map[string]string)
+	for _, k := range config.TSIGKeys {
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+			log.Errorf("Invalid secret of TSIG key %s: %s", k.Name, err)
+			continue
+		}
+		secrets[dns.CanonicalName(k.Name)] = k.Secret
+	}
+	return secrets
+}
+
+func getTrustAnchors(file string) []*dns.DS {
+	if file == "" {
+		return dnssec.DefaultTrustAnchors()
+	}
+	anchors, err := dnssec.LoadTrustAnchors(file)
+	if err != nil {
+		log.Errorf("Failed to load trust anchor file %s, using the root zone KSKs: %s", file, err)
+		return dnssec.DefaultTrustAnchors()
+	}
+	return anchors
+}
+
+func getWarmUpQuestions(file string) []dns.Question {
+	if file == "" {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Errorf("Failed to open cache warm-up file %s: %s", file, err)
+		return nil
+	}
+	defer f.Close()
+
+	var questions []dns.Question
+	failures := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		qtype := dns.TypeA
+		if len(words) > 1 {
+			t, ok := dns.StringToType[strings.ToUpper(words[1])]
+			if !ok {
+				log.Warnf("Invalid query type for domain %s: %s", words[0], words[1])
+				failures++
+				continue
+			}
+			qtype = t
+		}
+		questions = append(questions, dns.Question{Name: dns.Fqdn(words[0]), Qtype: qtype, Qclass: dns.ClassINET})
+	}
+
+	log.Infof("Cache warm-up file %s has been loaded with %d records (%d failed)", file, len(questions), failures)
+	return questions
+}
+
 func getDomainMatcher(name string) (m matcher.Matcher) {
 	switch name {
 	case "suffix-tree":
@@ -223,6 +645,8 @@ func getFinder(name string) (f finder.Finder) {
 		return &finderregex.List{RegexMap: make(map[string][]string, 100)}
 	case "full-map":
 		return &finderfull.Map{DataMap: make(map[string][]string, 100)}
+	case "suffix-tree":
+		return findersuffix.NewTree()
 	default:
 		log.Warnf("Finder %s does not exist, using full-map finder as default", name)
 		return &finderfull.Map{DataMap: make(map[string][]string, 100)}
@@ -10,17 +10,29 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/miekg/dns"
+	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/config"
+	"github.com/shawn1m/overture/core/hosts"
 	"github.com/shawn1m/overture/core/inbound"
+	"github.com/shawn1m/overture/core/leases"
 	"github.com/shawn1m/overture/core/outbound"
+	"github.com/shawn1m/overture/core/zone"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	srv  *inbound.Server
 	conf *config.Config
+
+	// Cache, zones, hosts and leases of the running server, which may differ from conf while reloading
+	runningCache  *cache.Cache
+	runningZones  *zone.Zones
+	runningHosts  *hosts.Hosts
+	runningLeases *leases.Leases
 )
 
 // Initiate the server with config file
@@ -35,6 +47,7 @@ func Start() {
 		PrimaryDNS:                  conf.PrimaryDNS,
 		AlternativeDNS:              conf.AlternativeDNS,
 		OnlyPrimaryDNS:              conf.OnlyPrimaryDNS,
+		Fallback:                    conf.Fallback,
 		WhenPrimaryDNSAnswerNoneUse: conf.WhenPrimaryDNSAnswerNoneUse,
 		IPNetworkPrimarySet:         conf.IPNetworkPrimarySet,
 		IPNetworkAlternativeSet:     conf.IPNetworkAlternativeSet,
@@ -42,16 +55,36 @@ func Start() {
 		DomainAlternativeList:       conf.DomainAlternativeList,
 
 		RedirectIPv6Record:       conf.IPv6UseAlternativeDNS,
+		AAAAPolicy:               conf.AAAAPolicyList,
+		DNS64:                    conf.DNS64Policy,
 		AlternativeDNSConcurrent: conf.AlternativeDNSConcurrent,
+		QueryTimeout:             time.Duration(conf.QueryTimeout) * time.Second,
+		PrimaryDNSSEC:            conf.DNSSEC.Primary,
+		AlternativeDNSSEC:        conf.DNSSEC.Alternative,
+		TrustAnchors:             conf.TrustAnchors,
+		ForwardZones:             conf.ForwardZones,
 		MinimumTTL:               conf.MinimumTTL,
 		DomainTTLMap:             conf.DomainTTLMap,
+		LocalSpecialUseNames:     conf.LocalSpecialUseNames,
 
-		Hosts: conf.Hosts,
-		Cache: conf.Cache,
+		Zones:        conf.LocalZones,
+		Hosts:        conf.Hosts,
+		Leases:       conf.Leases,
+		LocalRecords: conf.Records,
+		Cache:        conf.Cache,
 	}
 	dispatcher.Init()
+	runningCache = conf.Cache
+	runningZones = conf.LocalZones
+	runningZones.Start()
+	runningHosts = conf.Hosts
+	runningHosts.Start()
+	runningLeases = conf.Leases
+	runningLeases.Start()
+
+	go dispatcher.WarmUp(warmUpQuestions())
 
-	srv = inbound.NewServer(conf.BindAddress, conf.DebugHTTPAddress, dispatcher, conf.RejectQType, conf.DohEnabled)
+	srv = inbound.NewServer(conf.BindAddress, conf.DebugHTTPAddress, dispatcher, conf.RejectQType, conf.DohEnabled, conf.TSIGSecrets)
 	srv.HTTPMux.HandleFunc("/reload/config", ReloadConfigHandler)
 	srv.HTTPMux.HandleFunc("/reload", ReloadHandler)
 	srv.HTTPMux.HandleFunc("/config", ConfigHandler)
@@ -61,9 +94,34 @@ func Start() {
 
 // Stop server
 func Stop() {
+	saveCacheSnapshot()
+	runningZones.Stop()
+	runningHosts.Stop()
+	runningLeases.Stop()
 	srv.Stop()
 }
 
+func warmUpQuestions() []dns.Question {
+	questions := conf.WarmUpQuestions
+	if conf.CacheWarmUp.SnapshotFile != "" {
+		qs, err := cache.LoadSnapshot(conf.CacheWarmUp.SnapshotFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to load cache snapshot: %s", err)
+		}
+		questions = append(questions, qs...)
+	}
+	return questions
+}
+
+func saveCacheSnapshot() {
+	if runningCache == nil || conf.CacheWarmUp.SnapshotFile == "" {
+		return
+	}
+	if err := runningCache.SaveSnapshot(conf.CacheWarmUp.SnapshotFile, conf.CacheWarmUp.TopN); err != nil {
+		log.Warnf("Failed to save cache snapshot: %s", err)
+	}
+}
+
 // ReloadHandler is passed to http.Server for handle "/reload" request
 func ReloadHandler(w http.ResponseWriter, r *http.Request) {
 	conf = config.NewConfig(conf.FilePath)
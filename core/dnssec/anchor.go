@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package dnssec
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Root zone KSKs, see https://data.iana.org/root-anchors/root-anchors.xml
+var rootAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// DefaultTrustAnchors returns the DS records of the root zone KSKs.
+func DefaultTrustAnchors() []*dns.DS {
+	anchors, _ := parseTrustAnchors(strings.NewReader(rootAnchors), "")
+	return anchors
+}
+
+// LoadTrustAnchors reads DS or DNSKEY records in zone file format from file,
+// DNSKEY records are converted to their SHA-256 DS records.
+func LoadTrustAnchors(file string) ([]*dns.DS, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseTrustAnchors(f, file)
+}
+
+func parseTrustAnchors(r io.Reader, file string) ([]*dns.DS, error) {
+	var anchors []*dns.DS
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch a := rr.(type) {
+		case *dns.DS:
+			anchors = append(anchors, a)
+		case *dns.DNSKEY:
+			if ds := a.ToDS(dns.SHA256); ds != nil {
+				anchors = append(anchors, ds)
+			}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no DS or DNSKEY record")
+	}
+	return anchors, nil
+}
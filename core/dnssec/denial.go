@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package dnssec
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations is the limit of RFC 9276, denials by NSEC3 records with more iterations are insecure
+const maxNSEC3Iterations = 150
+
+const nsec3OptOut = 1
+
+// proof is the result of checking a denial of existence
+type proof int
+
+const (
+	unproven proof = iota
+	proven
+	optOut // proven up to an opt-out span of NSEC3 records, which may hide unsigned delegations
+)
+
+// denial holds the validated NSEC and NSEC3 records of a response
+type denial struct {
+	nsecs  []*dns.NSEC
+	nsec3s []*dns.NSEC3
+	// costly is set if NSEC3 records were ignored for their iterations
+	costly bool
+}
+
+func (d *denial) add(s *rrset) {
+	for _, rr := range s.rrs {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			d.nsecs = append(d.nsecs, r)
+		case *dns.NSEC3:
+			if r.Hash != dns.SHA1 {
+				continue
+			}
+			if r.Iterations > maxNSEC3Iterations {
+				d.costly = true
+				continue
+			}
+			d.nsec3s = append(d.nsec3s, r)
+		}
+	}
+}
+
+// prove checks that name does not exist if nxdomain is set, or that it has no qtype records otherwise,
+// as RFC 4035 section 5.4 and RFC 5155 section 8 describe.
+func (d *denial) prove(name string, qtype uint16, nxdomain bool) proof {
+	if len(d.nsecs) > 0 {
+		return d.nsecProof(name, qtype, nxdomain)
+	}
+	if len(d.nsec3s) > 0 {
+		return d.nsec3Proof(name, qtype, nxdomain)
+	}
+	return unproven
+}
+
+// proveWildcard checks that name, the owner of an answer expanded from a wildcard whose RRSIG has
+// labels labels, does not exist itself.
+func (d *denial) proveWildcard(name string, labels int) proof {
+	for _, n := range d.nsecs {
+		if nsecCovers(n, name) && !d.nsecDelegates(name) {
+			return proven
+		}
+	}
+	if n := d.nsec3Cover(ancestor(name, labels+1)); n != nil {
+		if n.Flags&nsec3OptOut != 0 {
+			return optOut
+		}
+		return proven
+	}
+	return unproven
+}
+
+func (d *denial) nsecProof(name string, qtype uint16, nxdomain bool) proof {
+	if d.nsecDelegates(name) {
+		return unproven
+	}
+	if !nxdomain {
+		for _, n := range d.nsecs {
+			if dns.CanonicalName(n.Hdr.Name) == name {
+				if deniesType(n.TypeBitMap, qtype) {
+					return proven
+				}
+				return unproven
+			}
+		}
+		// name is an empty non-terminal if the name next to it is below it
+		for _, n := range d.nsecs {
+			if nsecCovers(n, name) && dns.IsSubDomain(name, dns.CanonicalName(n.NextDomain)) {
+				return proven
+			}
+		}
+	}
+
+	var covering *dns.NSEC
+	for _, n := range d.nsecs {
+		if nsecCovers(n, name) {
+			covering = n
+			break
+		}
+	}
+	if covering == nil {
+		return unproven
+	}
+	// The closest encloser is the longest ancestor of name which the covering NSEC shows to exist
+	labels := dns.CompareDomainName(name, covering.Hdr.Name)
+	if l := dns.CompareDomainName(name, covering.NextDomain); l > labels {
+		labels = l
+	}
+	wildcard := wildcardName(ancestor(name, labels))
+	for _, n := range d.nsecs {
+		if nxdomain && nsecCovers(n, wildcard) {
+			return proven
+		}
+		if !nxdomain && dns.CanonicalName(n.Hdr.Name) == wildcard && deniesType(n.TypeBitMap, qtype) {
+			return proven
+		}
+	}
+	return unproven
+}
+
+// nsecDelegates reports whether an NSEC record shows that an ancestor of name is a delegation or a DNAME,
+// in which case name is not in the zone of the NSEC records.
+func (d *denial) nsecDelegates(name string) bool {
+	for _, n := range d.nsecs {
+		owner := dns.CanonicalName(n.Hdr.Name)
+		if owner == name || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if hasType(n.TypeBitMap, dns.TypeDNAME) || (hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *denial) nsec3Proof(name string, qtype uint16, nxdomain bool) proof {
+	if !nxdomain {
+		if n := d.nsec3Match(name); n != nil {
+			if deniesType(n.TypeBitMap, qtype) {
+				return proven
+			}
+			return unproven
+		}
+	}
+
+	ce, nextCloser := d.nsec3Encloser(name)
+	if nextCloser == nil {
+		return unproven
+	}
+	// An opt-out span covering the name of a missing DS proves an unsigned delegation
+	if !nxdomain && qtype == dns.TypeDS && nextCloser.Flags&nsec3OptOut != 0 {
+		return optOut
+	}
+	wildcard := wildcardName(ce)
+	if nxdomain {
+		if d.nsec3Cover(wildcard) == nil {
+			return unproven
+		}
+	} else if n := d.nsec3Match(wildcard); n == nil || !deniesType(n.TypeBitMap, qtype) {
+		return unproven
+	}
+	if nextCloser.Flags&nsec3OptOut != 0 {
+		return optOut
+	}
+	return proven
+}
+
+// nsec3Encloser returns the closest encloser of name, and the NSEC3 record covering the next closer name
+func (d *denial) nsec3Encloser(name string) (string, *dns.NSEC3) {
+	for labels := dns.CountLabel(name) - 1; labels >= 0; labels-- {
+		ce := ancestor(name, labels)
+		n := d.nsec3Match(ce)
+		if n == nil {
+			continue
+		}
+		if hasType(n.TypeBitMap, dns.TypeDNAME) || (hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)) {
+			return "", nil
+		}
+		return ce, d.nsec3Cover(ancestor(name, labels+1))
+	}
+	return "", nil
+}
+
+func (d *denial) nsec3Match(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsec3Cover(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3s {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsecCovers reports whether name falls between the owner and the next name of n
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := dns.CanonicalName(n.Hdr.Name), dns.CanonicalName(n.NextDomain)
+	if compareNames(owner, name) >= 0 {
+		return false
+	}
+	// The last NSEC of a zone points back to its apex
+	if compareNames(owner, next) >= 0 {
+		return dns.IsSubDomain(next, name)
+	}
+	return compareNames(name, next) < 0
+}
+
+// deniesType reports whether the type bitmap of a name proves that it has no qtype records. The bitmap
+// of the parent side of a delegation only proves that there is no DS.
+func deniesType(bitmap []uint16, qtype uint16) bool {
+	if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	if qtype == dns.TypeDS {
+		return !hasType(bitmap, dns.TypeSOA)
+	}
+	return !hasType(bitmap, dns.TypeNS) || hasType(bitmap, dns.TypeSOA)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compareNames orders names canonically as RFC 4034 section 6.1 defines
+func compareNames(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// ancestor returns the ancestor of name with the number of labels, or name if it has no more labels
+func ancestor(name string, labels int) string {
+	indexes := dns.Split(name)
+	if labels >= len(indexes) {
+		return name
+	}
+	if labels <= 0 {
+		return "."
+	}
+	return name[indexes[len(indexes)-labels]:]
+}
+
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
@@ -0,0 +1,608 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+// Package dnssec implements DNSSEC validation of upstream responses.
+package dnssec
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+// ExchangeFunc sends a query to the upstreams whose answers are validated, Resolver.Exchange fits.
+type ExchangeFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+type status int
+
+const (
+	insecure status = iota
+	secure
+	bogus
+	notZone // the name is not a zone apex
+)
+
+const (
+	maxDepth    = 16
+	maxChain    = 16
+	maxKeyTTL   = time.Hour
+	negativeTTL = 5 * time.Minute
+	// maxZones bounds the cached zones, which clients can grow by the names they ask for
+	maxZones = 10000
+)
+
+// validationError carries the Extended DNS Error code reported to the client
+type validationError struct {
+	code uint16
+	text string
+}
+
+func (e *validationError) Error() string {
+	return e.text
+}
+
+// zone is the cached security status of a zone and its validated keys
+type zone struct {
+	status status
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// Validator validates RRSIG chains from trust anchors down to the answers, keys of the zones
+// on the way are fetched with exchange and cached.
+type Validator struct {
+	anchors  map[string][]*dns.DS
+	exchange ExchangeFunc
+
+	zones     map[string]*zone
+	zonesLock sync.RWMutex
+}
+
+func NewValidator(anchors []*dns.DS, exchange ExchangeFunc) *Validator {
+	v := &Validator{anchors: make(map[string][]*dns.DS), exchange: exchange, zones: make(map[string]*zone)}
+	for _, ds := range anchors {
+		name := dns.CanonicalName(ds.Hdr.Name)
+		v.anchors[name] = append(v.anchors[name], ds)
+	}
+	return v
+}
+
+// SetDO asks for DNSSEC records with the DO bit in m.
+func SetDO(m *dns.Msg) {
+	if o := m.IsEdns0(); o != nil {
+		o.SetDo()
+		return
+	}
+	m.SetEdns0(4096, true)
+}
+
+// Validate checks the signatures of resp, the response to q. Secure responses get the AD bit,
+// bogus ones are replaced by SERVFAIL with an Extended DNS Error.
+func (v *Validator) Validate(ctx context.Context, q *dns.Msg, resp *dns.Msg) *dns.Msg {
+	if resp == nil || len(resp.Question) == 0 {
+		return resp
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return resp
+	}
+	st, err := v.validate(ctx, resp, 0)
+	switch st {
+	case secure:
+		resp.AuthenticatedData = true
+		return resp
+	case bogus:
+		log.Warnf("DNSSEC validation for %s failed: %s", resp.Question[0].String(), err)
+		m := new(dns.Msg)
+		m.SetRcode(q, dns.RcodeServerFailure)
+		common.SetExtendedError(m, err.code, err.text)
+		return m
+	default:
+		resp.AuthenticatedData = false
+		return resp
+	}
+}
+
+// FilterForClient removes DNSSEC records from resp unless the client asked for them with the DO bit,
+// and clears the AD bit if the client can not understand it.
+func FilterForClient(q *dns.Msg, resp *dns.Msg) {
+	if resp == nil {
+		return
+	}
+	o := q.IsEdns0()
+	if o != nil && o.Do() {
+		return
+	}
+	if !q.AuthenticatedData {
+		resp.AuthenticatedData = false
+	}
+	qtype := uint16(0)
+	if len(q.Question) > 0 {
+		qtype = q.Question[0].Qtype
+	}
+	resp.Answer = removeDNSSECRecords(resp.Answer, qtype)
+	resp.Ns = removeDNSSECRecords(resp.Ns, qtype)
+	resp.Extra = removeDNSSECRecords(resp.Extra, qtype)
+	if o == nil {
+		resp.Extra = removeRecords(resp.Extra, dns.TypeOPT)
+	} else if ro := resp.IsEdns0(); ro != nil {
+		ro.Hdr.Ttl &^= 1 << 15 // Clear the DO bit
+	}
+}
+
+func removeDNSSECRecords(rrs []dns.RR, qtype uint16) []dns.RR {
+	for _, t := range []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3} {
+		if t != qtype {
+			rrs = removeRecords(rrs, t)
+		}
+	}
+	return rrs
+}
+
+func removeRecords(rrs []dns.RR, t uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != t {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+// rrset is an RRset with the signatures covering it
+type rrset struct {
+	name string
+	t    uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+	// verified is the signature which proved the RRset secure
+	verified *dns.RRSIG
+}
+
+func rrsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, t uint16) *rrset {
+		for _, s := range sets {
+			if s.name == name && s.t == t {
+				return s
+			}
+		}
+		s := &rrset{name: name, t: t}
+		sets = append(sets, s)
+		return s
+	}
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		switch r := rr.(type) {
+		case *dns.OPT:
+		case *dns.RRSIG:
+			s := find(name, r.TypeCovered)
+			s.sigs = append(s.sigs, r)
+		default:
+			s := find(name, rr.Header().Rrtype)
+			s.rrs = append(s.rrs, rr)
+		}
+	}
+	return sets
+}
+
+// validate checks resp, whose answers must be a chain of CNAME and DNAME records from the question
+// name to the records asked for. The absence of the name or the type at the end of the chain, and of
+// names which answers were expanded from wildcards for, must be proven by NSEC or NSEC3 records.
+func (v *Validator) validate(ctx context.Context, resp *dns.Msg, depth int) (status, *validationError) {
+	if depth > maxDepth {
+		return bogus, &validationError{dns.ExtendedErrorCodeDNSSECIndeterminate, "chain of trust is too long"}
+	}
+	qtype := resp.Question[0].Qtype
+	name, chain, answered, err := answerChain(resp.Answer, dns.CanonicalName(resp.Question[0].Name), qtype)
+	if err != nil {
+		return bogus, err
+	}
+
+	result := secure
+	var expanded []*rrset
+	for _, s := range chain {
+		st, err := v.verifyRRSet(ctx, s, depth)
+		if st == bogus {
+			return bogus, err
+		}
+		if st == insecure {
+			result = insecure
+		}
+		if s.verified != nil && int(s.verified.Labels) < dns.CountLabel(s.name) {
+			expanded = append(expanded, s)
+		}
+	}
+	if result == insecure || (answered && len(expanded) == 0) {
+		return result, nil
+	}
+
+	d, err := v.denial(ctx, resp, depth)
+	if err != nil {
+		return bogus, err
+	}
+	if !answered {
+		switch d.prove(name, qtype, resp.Rcode == dns.RcodeNameError) {
+		case proven:
+		case optOut:
+			return insecure, nil
+		default:
+			return v.unproven(ctx, d, name, qtype, depth)
+		}
+	}
+	for _, s := range expanded {
+		switch d.proveWildcard(s.name, int(s.verified.Labels)) {
+		case proven:
+		case optOut:
+			return insecure, nil
+		default:
+			return v.unproven(ctx, d, s.name, qtype, depth)
+		}
+	}
+	return secure, nil
+}
+
+// answerChain follows the answers from name, and returns the name at the end of the chain, the RRsets
+// on the way and whether the chain ends in qtype records. Answers off the chain make resp bogus.
+func answerChain(answers []dns.RR, name string, qtype uint16) (string, []*rrset, bool, *validationError) {
+	sets := rrsets(answers)
+	used := make(map[*rrset]bool)
+	var chain []*rrset
+	answered := false
+	for hops := 0; !answered; hops++ {
+		if hops > maxChain {
+			return "", nil, false, &validationError{dns.ExtendedErrorCodeDNSBogus, "CNAME chain of " + name + " is too long"}
+		}
+		if s := findRRSet(sets, name, qtype); s != nil {
+			chain = append(chain, s)
+			used[s] = true
+			answered = true
+		} else if s, target := dnameRRSet(sets, name); s != nil {
+			chain = append(chain, s)
+			used[s] = true
+			// The CNAME synthesized from the DNAME is not signed
+			if c := findRRSet(sets, name, dns.TypeCNAME); c != nil {
+				if dns.CanonicalName(c.rrs[0].(*dns.CNAME).Target) != target {
+					return "", nil, false, &validationError{dns.ExtendedErrorCodeDNSBogus, "CNAME of " + name + " does not match its DNAME"}
+				}
+				used[c] = true
+			}
+			name = target
+		} else if s := findRRSet(sets, name, dns.TypeCNAME); s != nil {
+			chain = append(chain, s)
+			used[s] = true
+			name = dns.CanonicalName(s.rrs[0].(*dns.CNAME).Target)
+		} else {
+			break
+		}
+		// Answers of type ANY are all the RRsets of the name
+		if answered && qtype == dns.TypeANY {
+			for _, s := range sets {
+				if s.name == name && !used[s] {
+					chain = append(chain, s)
+					used[s] = true
+				}
+			}
+		}
+	}
+	for _, s := range sets {
+		if len(s.rrs) > 0 && !used[s] {
+			return "", nil, false, &validationError{dns.ExtendedErrorCodeDNSBogus, s.name + " " + dns.TypeToString[s.t] + " is not an answer to the question"}
+		}
+	}
+	return name, chain, answered, nil
+}
+
+func findRRSet(sets []*rrset, name string, t uint16) *rrset {
+	for _, s := range sets {
+		if s.name == name && len(s.rrs) > 0 && (s.t == t || (t == dns.TypeANY && s.t != dns.TypeCNAME)) {
+			return s
+		}
+	}
+	return nil
+}
+
+// dnameRRSet returns the DNAME RRset of an ancestor of name and the name it redirects name to
+func dnameRRSet(sets []*rrset, name string) (*rrset, string) {
+	for _, s := range sets {
+		if s.t != dns.TypeDNAME || len(s.rrs) == 0 || s.name == name || s.name == "." || !dns.IsSubDomain(s.name, name) {
+			continue
+		}
+		return s, name[:len(name)-len(s.name)] + dns.CanonicalName(s.rrs[0].(*dns.DNAME).Target)
+	}
+	return nil, ""
+}
+
+// denial returns the NSEC and NSEC3 records of the authority section of resp which are proven secure.
+// Records of insecure zones are ignored, so that they cannot deny names of secure ones.
+func (v *Validator) denial(ctx context.Context, resp *dns.Msg, depth int) (*denial, *validationError) {
+	d := new(denial)
+	for _, s := range rrsets(resp.Ns) {
+		if len(s.rrs) == 0 || (s.t != dns.TypeNSEC && s.t != dns.TypeNSEC3 && s.t != dns.TypeSOA) {
+			continue
+		}
+		st, err := v.verifyRRSet(ctx, s, depth)
+		if st == bogus {
+			return nil, err
+		}
+		if st == secure {
+			d.add(s)
+		}
+	}
+	return d, nil
+}
+
+// unproven returns the status of a response lacking the denial of existence of name, which is only
+// fine outside of signed zones. DS records belong to the parent zone.
+func (v *Validator) unproven(ctx context.Context, d *denial, name string, qtype uint16, depth int) (status, *validationError) {
+	if qtype == dns.TypeDS && name != "." {
+		name = parentName(name)
+	}
+	st, err := v.security(ctx, name, depth+1)
+	if st != secure {
+		return st, err
+	}
+	if d.costly {
+		return insecure, nil
+	}
+	return bogus, &validationError{dns.ExtendedErrorCodeNSECMissing, "missing denial of existence for " + name}
+}
+
+func (v *Validator) verifyRRSet(ctx context.Context, s *rrset, depth int) (status, *validationError) {
+	if len(s.sigs) == 0 {
+		st, err := v.security(ctx, s.name, depth+1)
+		if st == secure {
+			return bogus, &validationError{dns.ExtendedErrorCodeRRSIGsMissing, "missing RRSIG for " + s.name + " " + dns.TypeToString[s.t]}
+		}
+		return st, err
+	}
+
+	err := &validationError{dns.ExtendedErrorCodeDNSBogus, "no valid RRSIG for " + s.name + " " + dns.TypeToString[s.t]}
+	for _, sig := range s.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, s.name) {
+			continue
+		}
+		z, zerr := v.zone(ctx, signer, depth+1, false)
+		if zerr != nil {
+			err = zerr
+			continue
+		}
+		if z.status == insecure {
+			return insecure, nil
+		}
+		if verr := verifySignature(sig, z.keys, s.rrs); verr != nil {
+			err = verr
+			continue
+		}
+		s.verified = sig
+		return secure, nil
+	}
+	return bogus, err
+}
+
+func verifySignature(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR) *validationError {
+	if !sig.ValidityPeriod(time.Now()) {
+		return &validationError{dns.ExtendedErrorCodeSignatureExpired, "RRSIG of " + sig.Hdr.Name + " is expired or not yet valid"}
+	}
+	for _, k := range keys {
+		if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+			continue
+		}
+		if sig.Verify(k, rrs) == nil {
+			return nil
+		}
+	}
+	return &validationError{dns.ExtendedErrorCodeDNSBogus, "RRSIG of " + sig.Hdr.Name + " does not match any DNSKEY"}
+}
+
+// security follows the chain of trust down to name and reports whether name is in a signed zone
+func (v *Validator) security(ctx context.Context, name string, depth int) (status, *validationError) {
+	apex, ok := v.closestAnchor(name)
+	if !ok {
+		return insecure, nil
+	}
+	if _, err := v.zone(ctx, apex, depth+1, false); err != nil {
+		return bogus, err
+	}
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		candidate := name[labels[i]:]
+		if candidate == apex || !dns.IsSubDomain(apex, candidate) {
+			continue
+		}
+		z, err := v.zone(ctx, candidate, depth+1, candidate == name)
+		if err != nil {
+			return bogus, err
+		}
+		switch z.status {
+		case insecure:
+			return insecure, nil
+		case secure:
+			apex = candidate
+		}
+	}
+	return secure, nil
+}
+
+func (v *Validator) closestAnchor(name string) (string, bool) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := v.anchors[name[off:]]; ok {
+			return name[off:], true
+		}
+	}
+	if _, ok := v.anchors["."]; ok {
+		return ".", true
+	}
+	return "", false
+}
+
+// zone returns the security status of the zone whose apex might be name, with its keys if it is secure.
+// leaf is set for the names asked for by clients, which are only cached if they are zone apexes.
+func (v *Validator) zone(ctx context.Context, name string, depth int, leaf bool) (*zone, *validationError) {
+	if depth > maxDepth {
+		return nil, &validationError{dns.ExtendedErrorCodeDNSSECIndeterminate, "chain of trust is too long"}
+	}
+	v.zonesLock.RLock()
+	z, ok := v.zones[name]
+	v.zonesLock.RUnlock()
+	if ok && time.Now().Before(z.expire) {
+		return z, nil
+	}
+
+	z, err := v.fetchZone(ctx, name, depth)
+	if err != nil {
+		return nil, err
+	}
+	if z.status != notZone || !leaf {
+		v.storeZone(name, z)
+	}
+	return z, nil
+}
+
+// storeZone caches z, a full cache removes its expired zones and then random ones until a tenth of it is free
+func (v *Validator) storeZone(name string, z *zone) {
+	now := time.Now()
+
+	v.zonesLock.Lock()
+	defer v.zonesLock.Unlock()
+	if _, ok := v.zones[name]; !ok && len(v.zones) >= maxZones {
+		for n, cached := range v.zones {
+			if !now.Before(cached.expire) {
+				delete(v.zones, n)
+			}
+		}
+		for n := range v.zones {
+			if len(v.zones) < maxZones-maxZones/10 {
+				break
+			}
+			delete(v.zones, n)
+		}
+	}
+	v.zones[name] = z
+}
+
+func (v *Validator) fetchZone(ctx context.Context, name string, depth int) (*zone, *validationError) {
+	ds, ok := v.anchors[name]
+	if !ok {
+		if _, ok := v.closestAnchor(name); !ok {
+			return &zone{status: insecure, expire: time.Now().Add(negativeTTL)}, nil
+		}
+		resp, err := v.query(ctx, name, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		st, err := v.validate(ctx, resp, depth+1)
+		if st == bogus {
+			return nil, err
+		}
+		for _, rr := range resp.Answer {
+			if d, ok := rr.(*dns.DS); ok && dns.CanonicalName(d.Hdr.Name) == name {
+				ds = append(ds, d)
+			}
+		}
+		if st == insecure {
+			return &zone{status: insecure, expire: time.Now().Add(negativeTTL)}, nil
+		}
+		if len(ds) == 0 {
+			// No DS is proven, name is either an unsigned zone or not a zone apex at all
+			apex, err := v.isApex(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if apex {
+				return &zone{status: insecure, expire: time.Now().Add(negativeTTL)}, nil
+			}
+			return &zone{status: notZone, expire: time.Now().Add(negativeTTL)}, nil
+		}
+	}
+
+	resp, err := v.query(ctx, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := &rrset{name: name, t: dns.TypeDNSKEY}
+	for _, s := range rrsets(resp.Answer) {
+		if s.name == name && s.t == dns.TypeDNSKEY {
+			set = s
+		}
+	}
+	var keys []*dns.DNSKEY
+	ttl := maxKeyTTL
+	for _, rr := range set.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	// The DNSKEY RRset must be signed by a key matching one of the DS records
+	for _, k := range keys {
+		if !matchDS(k, ds) {
+			continue
+		}
+		for _, sig := range set.sigs {
+			if verifySignature(sig, []*dns.DNSKEY{k}, set.rrs) == nil {
+				return &zone{status: secure, keys: keys, expire: time.Now().Add(ttl)}, nil
+			}
+		}
+	}
+	return nil, &validationError{dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of " + name + " matches its DS"}
+}
+
+func matchDS(k *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+			continue
+		}
+		if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// isApex reports whether name has an SOA record, only its being a zone apex is trusted this way
+// as it leads to further validation.
+func (v *Validator) isApex(ctx context.Context, name string) (bool, *validationError) {
+	resp, err := v.query(ctx, name, dns.TypeSOA)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeSOA && dns.CanonicalName(rr.Header().Name) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (v *Validator) query(ctx context.Context, name string, t uint16) (*dns.Msg, *validationError) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, t)
+	m.CheckingDisabled = true
+	SetDO(m)
+	resp, err := v.exchange(ctx, m)
+	if err != nil || resp == nil {
+		return nil, &validationError{dns.ExtendedErrorCodeDNSSECIndeterminate, "query " + dns.TypeToString[t] + " of " + name + " failed"}
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, &validationError{dns.ExtendedErrorCodeDNSSECIndeterminate, "query " + dns.TypeToString[t] + " of " + name + " returned " + dns.RcodeToString[resp.Rcode]}
+	}
+	return resp, nil
+}
+
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
@@ -0,0 +1,512 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+)
+
+// signedZones answers from records and signs them with one key per zone. CNAMEs are followed and
+// wildcards expanded, missing names and types are denied by NSEC or NSEC3 records, and DNSSEC
+// records are only sent to queries with the DO bit.
+type signedZones struct {
+	keys        map[string]*dns.DNSKEY
+	privs       map[string]crypto.Signer
+	records     map[string][]dns.RR
+	delegations map[string]bool // unsigned delegations
+	nsec3       bool
+}
+
+func newRR(s string) dns.RR {
+	rr, _ := dns.NewRR(s)
+	return rr
+}
+
+func newSignedZones(t *testing.T, zones ...string) *signedZones {
+	s := &signedZones{keys: make(map[string]*dns.DNSKEY), privs: make(map[string]crypto.Signer),
+		records: make(map[string][]dns.RR), delegations: make(map[string]bool)}
+	for _, z := range zones {
+		k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: z, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+		priv, err := k.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.keys[z] = k
+		s.privs[z] = priv.(crypto.Signer)
+		s.add(z, k)
+		apex := strings.TrimPrefix(z, ".")
+		s.add(z, newRR(z+" 3600 IN SOA ns."+apex+" admin."+apex+" 1 3600 600 86400 300"))
+	}
+	for _, z := range zones {
+		if z != "." {
+			s.add(parentName(z), s.keys[z].ToDS(dns.SHA256))
+		}
+	}
+	return s
+}
+
+func (s *signedZones) sign(zone string, rrs []dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{KeyTag: s.keys[zone].KeyTag(), SignerName: zone, Algorithm: dns.ECDSAP256SHA256,
+		Inception: uint32(time.Now().Add(-time.Hour).Unix()), Expiration: uint32(time.Now().Add(time.Hour).Unix())}
+	if err := sig.Sign(s.privs[zone], rrs); err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// add puts rr and the signature of its RRset by zone into the records
+func (s *signedZones) add(zone string, rr dns.RR) {
+	key := rr.Header().Name + "/" + dns.TypeToString[rr.Header().Rrtype]
+	var rrs []dns.RR
+	for _, r := range s.records[key] {
+		if r.Header().Rrtype != dns.TypeRRSIG {
+			rrs = append(rrs, r)
+		}
+	}
+	rrs = append(rrs, rr)
+	if zone != "" {
+		s.records[key] = append(rrs, s.sign(zone, rrs))
+	} else {
+		s.records[key] = rrs
+	}
+}
+
+// delegate adds an unsigned delegation of name to its zone
+func (s *signedZones) delegate(name string) {
+	s.delegations[name] = true
+	s.add("", newRR(name+" 3600 IN NS ns."+name))
+}
+
+func (s *signedZones) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetReply(q)
+	name, qtype := q.Question[0].Name, q.Question[0].Qtype
+	for i := 0; ; i++ {
+		if rrs, ok := s.records[name+"/"+dns.TypeToString[qtype]]; ok {
+			m.Answer = append(m.Answer, rrs...)
+			return s.filter(q, m), nil
+		}
+		rrs, ok := s.records[name+"/CNAME"]
+		if !ok || i > 8 {
+			break
+		}
+		m.Answer = append(m.Answer, rrs...)
+		name = rrs[0].(*dns.CNAME).Target
+	}
+
+	zone := s.zone(name)
+	types := s.owners(zone)
+	m.Ns = append(m.Ns, s.records[zone+"/SOA"]...)
+	if types[name] != nil || s.nonTerminal(types, name) {
+		if s.nsec3 {
+			m.Ns = append(m.Ns, s.nsec3At(zone, types, name)...)
+		} else if types[name] != nil {
+			m.Ns = append(m.Ns, s.nsecAt(zone, types, name)...)
+		} else {
+			m.Ns = append(m.Ns, s.nsecCovering(zone, types, name)...)
+		}
+		return s.filter(q, m), nil
+	}
+
+	ce := parentName(name)
+	for types[ce] == nil && !s.nonTerminal(types, ce) {
+		ce = parentName(ce)
+	}
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	if rrs, ok := s.records[wildcard+"/"+dns.TypeToString[qtype]]; ok {
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			m.Answer = append(m.Answer, rr)
+		}
+		m.Ns = nil
+		if s.nsec3 {
+			m.Ns = append(m.Ns, s.nsec3Covering(zone, types, ancestor(name, dns.CountLabel(ce)+1))...)
+		} else {
+			m.Ns = append(m.Ns, s.nsecCovering(zone, types, name)...)
+		}
+		return s.filter(q, m), nil
+	}
+
+	m.Rcode = dns.RcodeNameError
+	if s.nsec3 {
+		m.Ns = append(m.Ns, s.nsec3At(zone, types, ce)...)
+		m.Ns = append(m.Ns, s.nsec3Covering(zone, types, ancestor(name, dns.CountLabel(ce)+1))...)
+		m.Ns = append(m.Ns, s.nsec3Covering(zone, types, wildcard)...)
+	} else {
+		m.Ns = append(m.Ns, s.nsecCovering(zone, types, name)...)
+		if w := s.nsecCovering(zone, types, wildcard); w[0].Header().Name != m.Ns[len(m.Ns)-2].Header().Name {
+			m.Ns = append(m.Ns, w...)
+		}
+	}
+	return s.filter(q, m), nil
+}
+
+// filter removes DNSSEC records unless q has the DO bit
+func (s *signedZones) filter(q *dns.Msg, m *dns.Msg) *dns.Msg {
+	if o := q.IsEdns0(); o == nil || !o.Do() {
+		m.Answer = removeDNSSECRecords(m.Answer, q.Question[0].Qtype)
+		m.Ns = removeDNSSECRecords(m.Ns, q.Question[0].Qtype)
+	}
+	return m
+}
+
+// zone returns the closest signed zone of name
+func (s *signedZones) zone(name string) string {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := s.keys[name[off:]]; ok {
+			return name[off:]
+		}
+	}
+	return "."
+}
+
+// owners returns the names of zone with the types of their records, including the delegations
+func (s *signedZones) owners(zone string) map[string][]uint16 {
+	types := make(map[string][]uint16)
+	for key, rrs := range s.records {
+		name := key[:strings.LastIndexByte(key, '/')]
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.SignerName == zone {
+				types[name] = append(types[name], sig.TypeCovered)
+			}
+		}
+	}
+	for name := range s.keys {
+		if name != zone && parentName(name) == zone {
+			types[name] = append(types[name], dns.TypeNS)
+		}
+	}
+	for name := range s.delegations {
+		if s.zone(name) == zone {
+			types[name] = append(types[name], dns.TypeNS)
+		}
+	}
+	for name, ts := range types {
+		ts = append(ts, dns.TypeRRSIG)
+		if !s.nsec3 {
+			ts = append(ts, dns.TypeNSEC)
+		}
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+		types[name] = ts
+	}
+	return types
+}
+
+func (s *signedZones) nonTerminal(types map[string][]uint16, name string) bool {
+	for owner := range types {
+		if owner != name && dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedNames(types map[string][]uint16) []string {
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return compareNames(names[i], names[j]) < 0 })
+	return names
+}
+
+func (s *signedZones) nsecAt(zone string, types map[string][]uint16, owner string) []dns.RR {
+	names := sortedNames(types)
+	next := names[0]
+	for i, name := range names {
+		if name == owner && i+1 < len(names) {
+			next = names[i+1]
+		}
+	}
+	nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next, TypeBitMap: types[owner]}
+	return []dns.RR{nsec, s.sign(zone, []dns.RR{nsec})}
+}
+
+func (s *signedZones) nsecCovering(zone string, types map[string][]uint16, name string) []dns.RR {
+	names := sortedNames(types)
+	owner := names[len(names)-1]
+	for _, n := range names {
+		if compareNames(n, name) < 0 {
+			owner = n
+		}
+	}
+	return s.nsecAt(zone, types, owner)
+}
+
+// hashes returns the NSEC3 hashes of the names of zone and their empty non-terminals with their types
+func (s *signedZones) hashes(zone string, types map[string][]uint16) ([]string, map[string][]uint16) {
+	hashed := make(map[string][]uint16)
+	for name, ts := range types {
+		hashed[dns.HashName(name, dns.SHA1, 0, "")] = ts
+		for n := parentName(name); n != zone && dns.IsSubDomain(zone, n); n = parentName(n) {
+			if h := dns.HashName(n, dns.SHA1, 0, ""); hashed[h] == nil {
+				hashed[h] = []uint16{}
+			}
+		}
+	}
+	var hs []string
+	for h := range hashed {
+		hs = append(hs, h)
+	}
+	sort.Strings(hs)
+	return hs, hashed
+}
+
+func (s *signedZones) nsec3Hash(zone string, types map[string][]uint16, hash string) []dns.RR {
+	hs, hashed := s.hashes(zone, types)
+	next := hs[0]
+	for i, h := range hs {
+		if h == hash && i+1 < len(hs) {
+			next = hs[i+1]
+		}
+	}
+	nsec3 := &dns.NSEC3{Hdr: dns.RR_Header{Name: strings.ToLower(hash) + "." + strings.TrimPrefix(zone, "."), Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash: dns.SHA1, HashLength: 20, NextDomain: next, TypeBitMap: hashed[hash]}
+	return []dns.RR{nsec3, s.sign(zone, []dns.RR{nsec3})}
+}
+
+func (s *signedZones) nsec3At(zone string, types map[string][]uint16, name string) []dns.RR {
+	return s.nsec3Hash(zone, types, dns.HashName(name, dns.SHA1, 0, ""))
+}
+
+func (s *signedZones) nsec3Covering(zone string, types map[string][]uint16, name string) []dns.RR {
+	hs, _ := s.hashes(zone, types)
+	hash := dns.HashName(name, dns.SHA1, 0, "")
+	owner := hs[len(hs)-1]
+	for _, h := range hs {
+		if h < hash {
+			owner = h
+		}
+	}
+	return s.nsec3Hash(zone, types, owner)
+}
+
+func query(name string, do bool) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	if do {
+		SetDO(q)
+	}
+	return q
+}
+
+func TestValidator(t *testing.T) {
+	zones := newSignedZones(t, ".", "example.")
+	zones.add("example.", newRR("www.example. 300 IN A 10.0.0.1"))
+	zones.delegate("insecure.")
+	zones.add("", newRR("insecure. 3600 IN SOA ns.insecure. admin.insecure. 1 3600 600 86400 300"))
+	zones.add("", newRR("www.insecure. 300 IN A 10.0.0.2"))
+	v := NewValidator([]*dns.DS{zones.keys["."].ToDS(dns.SHA256)}, zones.exchange)
+	ctx := context.Background()
+
+	q := query("www.example.", true)
+	resp, _ := zones.exchange(ctx, q)
+	if resp = v.Validate(ctx, q, resp); !resp.AuthenticatedData || len(resp.Answer) != 2 {
+		t.Errorf("secure answer should be authenticated: %s", resp)
+	}
+
+	resp, _ = zones.exchange(ctx, q)
+	resp.Answer[0].(*dns.A).A = net.ParseIP("10.0.0.99")
+	if resp = v.Validate(ctx, q, resp); resp.Rcode != dns.RcodeServerFailure || resp.IsEdns0() == nil {
+		t.Errorf("forged answer should be SERVFAIL with extended error: %s", resp)
+	}
+
+	resp, _ = zones.exchange(ctx, q)
+	resp.Answer = resp.Answer[:1]
+	if resp = v.Validate(ctx, q, resp); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("unsigned answer in signed zone should be SERVFAIL: %s", resp)
+	}
+
+	q = query("www.insecure.", true)
+	resp, _ = zones.exchange(ctx, q)
+	if resp = v.Validate(ctx, q, resp); resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData {
+		t.Errorf("answer in unsigned zone should pass without AD: %s", resp)
+	}
+
+	q = query("none.example.", true)
+	resp, _ = zones.exchange(ctx, q)
+	if resp = v.Validate(ctx, q, resp); !resp.AuthenticatedData {
+		t.Errorf("signed negative answer should be authenticated: %s", resp)
+	}
+}
+
+func TestValidator_Denial(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		zones := newSignedZones(t, ".", "example.")
+		zones.nsec3 = nsec3
+		zones.add("example.", newRR("www.example. 300 IN A 10.0.0.1"))
+		zones.add("example.", newRR("a.b.example. 300 IN A 10.0.0.2"))
+		zones.add("example.", newRR("*.wild.example. 300 IN A 10.0.0.3"))
+		v := NewValidator([]*dns.DS{zones.keys["."].ToDS(dns.SHA256)}, zones.exchange)
+		ctx := context.Background()
+
+		validate := func(q *dns.Msg, change func(*dns.Msg)) *dns.Msg {
+			resp, _ := zones.exchange(ctx, q)
+			if change != nil {
+				change(resp)
+			}
+			return v.Validate(ctx, q, resp)
+		}
+		aaaa := query("www.example.", true)
+		aaaa.Question[0].Qtype = dns.TypeAAAA
+
+		if resp := validate(query("none.example.", true), nil); resp.Rcode != dns.RcodeNameError || !resp.AuthenticatedData {
+			t.Errorf("NXDOMAIN with NSEC3 %v should be authenticated: %s", nsec3, resp)
+		}
+		if resp := validate(aaaa, nil); resp.Rcode != dns.RcodeSuccess || !resp.AuthenticatedData {
+			t.Errorf("NODATA with NSEC3 %v should be authenticated: %s", nsec3, resp)
+		}
+		if resp := validate(query("b.example.", true), nil); resp.Rcode != dns.RcodeSuccess || !resp.AuthenticatedData {
+			t.Errorf("NODATA of empty non-terminal with NSEC3 %v should be authenticated: %s", nsec3, resp)
+		}
+		if resp := validate(query("x.wild.example.", true), nil); len(resp.Answer) != 2 || !resp.AuthenticatedData {
+			t.Errorf("wildcard answer with NSEC3 %v should be authenticated: %s", nsec3, resp)
+		}
+
+		// A signed SOA replayed without the proof
+		if resp := validate(query("none.example.", true), func(m *dns.Msg) { m.Ns = m.Ns[:2] }); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("NXDOMAIN without proof with NSEC3 %v should be SERVFAIL: %s", nsec3, resp)
+		}
+		if resp := validate(aaaa, func(m *dns.Msg) { m.Ns = m.Ns[:2] }); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("NODATA without proof with NSEC3 %v should be SERVFAIL: %s", nsec3, resp)
+		}
+		// The proof of another type or name
+		nodata, _ := zones.exchange(ctx, aaaa)
+		if resp := validate(query("www.example.", true), func(m *dns.Msg) { m.Answer, m.Ns = nil, nodata.Ns }); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("NODATA of existing type with NSEC3 %v should be SERVFAIL: %s", nsec3, resp)
+		}
+		if resp := validate(query("www.example.", true), func(m *dns.Msg) { m.Answer, m.Rcode = nil, dns.RcodeNameError; m.Ns = nodata.Ns }); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("NXDOMAIN of existing name with NSEC3 %v should be SERVFAIL: %s", nsec3, resp)
+		}
+		if resp := validate(query("x.wild.example.", true), func(m *dns.Msg) { m.Ns = nil }); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("wildcard answer without proof with NSEC3 %v should be SERVFAIL: %s", nsec3, resp)
+		}
+	}
+}
+
+func TestValidator_AnswerChain(t *testing.T) {
+	zones := newSignedZones(t, ".", "example.")
+	zones.add("example.", newRR("www.example. 300 IN A 10.0.0.1"))
+	zones.add("example.", newRR("other.example. 300 IN A 10.0.0.2"))
+	zones.add("example.", newRR("alias.example. 300 IN CNAME www.example."))
+	zones.add("example.", newRR("dangling.example. 300 IN CNAME none.example."))
+	v := NewValidator([]*dns.DS{zones.keys["."].ToDS(dns.SHA256)}, zones.exchange)
+	ctx := context.Background()
+
+	q := query("alias.example.", true)
+	resp, _ := zones.exchange(ctx, q)
+	if resp = v.Validate(ctx, q, resp); !resp.AuthenticatedData || len(resp.Answer) != 4 {
+		t.Errorf("CNAME chain should be authenticated: %s", resp)
+	}
+
+	q = query("dangling.example.", true)
+	resp, _ = zones.exchange(ctx, q)
+	if resp = v.Validate(ctx, q, resp); resp.Rcode != dns.RcodeNameError || !resp.AuthenticatedData {
+		t.Errorf("CNAME to missing name should be authenticated NXDOMAIN: %s", resp)
+	}
+
+	// Signed answers of another name
+	q = query("none.example.", true)
+	resp, _ = zones.exchange(ctx, query("www.example.", true))
+	resp.Question = q.Question
+	if resp = v.Validate(ctx, q, resp); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("answer of another name should be SERVFAIL: %s", resp)
+	}
+
+	q = query("www.example.", true)
+	resp, _ = zones.exchange(ctx, q)
+	other, _ := zones.exchange(ctx, query("other.example.", true))
+	resp.Answer = append(resp.Answer, other.Answer...)
+	if resp = v.Validate(ctx, q, resp); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("answer with records off the chain should be SERVFAIL: %s", resp)
+	}
+}
+
+func TestValidator_Recursive(t *testing.T) {
+	zones := newSignedZones(t, ".", "example.")
+	zones.add("example.", newRR("www.example. 300 IN A 10.0.0.1"))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		m, _ := zones.exchange(context.Background(), q)
+		m.Authoritative = true
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	r := resolver.NewResolver(&common.DNSUpstream{Name: "Recursive", Address: conn.LocalAddr().String(), Protocol: "recursive",
+		Timeout: 6, EDNSClientSubnet: &common.EDNSClientSubnetType{Policy: "disable"}})
+	v := NewValidator([]*dns.DS{zones.keys["."].ToDS(dns.SHA256)}, r.Exchange)
+	ctx := context.Background()
+
+	for _, name := range []string{"www.example.", "none.example."} {
+		q := query(name, true)
+		resp, err := r.Exchange(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp = v.Validate(ctx, q, resp); !resp.AuthenticatedData {
+			t.Errorf("answer of recursive resolver should be authenticated: %s", resp)
+		}
+	}
+}
+
+func TestValidator_Zones(t *testing.T) {
+	zones := newSignedZones(t, ".", "example.")
+	zones.add("example.", newRR("a.b.example. 300 IN A 10.0.0.1"))
+	v := NewValidator([]*dns.DS{zones.keys["."].ToDS(dns.SHA256)}, zones.exchange)
+	ctx := context.Background()
+
+	q := query("a.b.example.", true)
+	resp, _ := zones.exchange(ctx, q)
+	resp.Answer = resp.Answer[:1]
+	v.Validate(ctx, q, resp)
+	if z := v.zones["b.example."]; z == nil || z.status != notZone {
+		t.Errorf("name between zone apexes should be cached, got %+v", z)
+	}
+	if z := v.zones["a.b.example."]; z != nil {
+		t.Errorf("leaf name should not be cached, got %+v", z)
+	}
+
+	for i := 0; i < 2*maxZones; i++ {
+		v.storeZone(fmt.Sprintf("%d.example.", i), &zone{status: notZone, expire: time.Now().Add(negativeTTL)})
+	}
+	if len(v.zones) > maxZones {
+		t.Errorf("%d zones should be cached at most, got %d", maxZones, len(v.zones))
+	}
+}
+
+func TestFilterForClient(t *testing.T) {
+	zones := newSignedZones(t, ".")
+	zones.add(".", newRR("www. 300 IN A 10.0.0.1"))
+
+	resp, _ := zones.exchange(context.Background(), query("www.", true))
+	resp.AuthenticatedData = true
+	FilterForClient(query("www.", false), resp)
+	if len(resp.Answer) != 1 || resp.AuthenticatedData || resp.IsEdns0() != nil {
+		t.Errorf("DNSSEC records should be removed: %s", resp)
+	}
+
+	resp, _ = zones.exchange(context.Background(), query("www.", true))
+	FilterForClient(query("www.", true), resp)
+	if len(resp.Answer) != 2 {
+		t.Errorf("DNSSEC records should be kept: %s", resp)
+	}
+}
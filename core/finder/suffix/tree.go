@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package suffix
+
+import (
+	"errors"
+	"strings"
+)
+
+// Tree is a finder of domains by labels, keys like "*.lan.example" match every subdomain of
+// "lan.example" without values of its own, and the closest wildcard wins.
+type Tree struct {
+	sub      map[string]*Tree
+	values   []string
+	wildcard []string
+}
+
+func NewTree() *Tree {
+	return &Tree{sub: make(map[string]*Tree)}
+}
+
+func (t *Tree) Insert(k string, v string) error {
+	k = strings.Trim(strings.ToLower(k), ".")
+	isWildcard := strings.HasPrefix(k, "*.")
+	if isWildcard {
+		k = k[2:]
+	}
+	if k == "" || strings.Contains(k, "*") {
+		return errors.New("invalid domain " + k)
+	}
+
+	node := t
+	labels := strings.Split(k, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		next, ok := node.sub[labels[i]]
+		if !ok {
+			next = NewTree()
+			node.sub[labels[i]] = next
+		}
+		node = next
+	}
+	if isWildcard {
+		node.wildcard = append(node.wildcard, v)
+	} else {
+		node.values = append(node.values, v)
+	}
+	return nil
+}
+
+func (t *Tree) Get(k string) []string {
+	k = strings.Trim(strings.ToLower(k), ".")
+	if k == "" {
+		return nil
+	}
+
+	var wildcard []string
+	node := t
+	labels := strings.Split(k, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if len(node.wildcard) > 0 {
+			wildcard = node.wildcard
+		}
+		next, ok := node.sub[labels[i]]
+		if !ok {
+			return wildcard
+		}
+		node = next
+	}
+	if len(node.values) > 0 {
+		return node.values
+	}
+	return wildcard
+}
+
+func (t *Tree) Name() string {
+	return "suffix-tree"
+}
@@ -2,14 +2,17 @@
 // Use of this source code is governed by The MIT License (MIT) that can be
 // found in the LICENSE file.
 
-// Package hosts provides address lookups from hosts file.
+// Package hosts provides address lookups from hosts files.
 package hosts
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"net"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shawn1m/overture/core/errors"
@@ -17,10 +20,29 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// Hosts represents a file containing hosts_sample
+// DefaultTTL is the TTL of answers from hosts unless it is configured
+const DefaultTTL = 3600
+
+// Hosts represents hosts files, directories of them or URLs, which are reloaded when they change
 type Hosts struct {
-	filePath string
-	finder   finder.Finder
+	// TTL of the answers from hosts
+	TTL uint32
+
+	sources   []*source
+	newFinder func() finder.Finder
+	interval  time.Duration
+	// table is the current *table, which is replaced as a whole on reload
+	table atomic.Value
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+}
+
+// table is the parsed content of all sources
+type table struct {
+	finder finder.Finder
+	// reverse maps IP addresses to their names in order, wildcards and regex excluded
+	reverse map[string][]string
 }
 
 type hostsLine struct {
@@ -29,22 +51,97 @@ type hostsLine struct {
 	isIpv6 bool
 }
 
+// New loads the hosts file of path into finder, it is not reloaded.
 func New(path string, finder finder.Finder) (*Hosts, error) {
 	if path == "" {
 		return nil, nil
 	}
 
-	h := &Hosts{filePath: path, finder: finder}
-	if err := h.initHosts(); err != nil {
+	h := &Hosts{TTL: DefaultTTL, sources: []*source{newSource(path)}}
+	if _, err := h.sources[0].poll(); err != nil {
 		return nil, err
 	}
+	h.table.Store(h.parse(finder))
 
 	return h, nil
 }
 
+// Load loads hosts from sources, which are hosts files, directories of hosts files and HTTP(S) URLs.
+// Sources failing to load are logged and skipped. After Start, sources are checked every interval and
+// reloaded into a finder created by newFinder when any of them changes.
+func Load(sources []string, newFinder func() finder.Finder, interval time.Duration) *Hosts {
+	h := &Hosts{TTL: DefaultTTL, newFinder: newFinder, interval: interval}
+	for _, location := range sources {
+		s := newSource(location)
+		if _, err := s.pollChanged(); err != nil {
+			log.Warnf("Failed to load hosts from %s: %s", location, err)
+		}
+		h.sources = append(h.sources, s)
+	}
+	h.table.Store(h.parse(newFinder()))
+	return h
+}
+
+// Start starts checking the sources for changes until Stop is called.
+func (h *Hosts) Start() {
+	if h == nil || h.newFinder == nil || h.interval <= 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.cancel != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(context.Background())
+	go h.watch(ctx)
+}
+
+// Stop stops checking the sources for changes.
+func (h *Hosts) Stop() {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+	}
+}
+
+func (h *Hosts) watch(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed := false
+		for _, s := range h.sources {
+			c, err := s.pollChanged()
+			if err != nil {
+				log.Warnf("Failed to reload hosts from %s: %s", s.location, err)
+			}
+			changed = changed || c
+		}
+		if changed {
+			h.table.Store(h.parse(h.newFinder()))
+			log.Info("Hosts have been reloaded")
+		}
+	}
+}
+
+func (h *Hosts) current() *table {
+	return h.table.Load().(*table)
+}
+
 func (h *Hosts) Find(name string) (ipv4List []net.IP, ipv6List []net.IP) {
-	name = strings.TrimSuffix(name, ".")
-	hostsLines := h.findHosts(name)
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	hostsLines := h.current().findHosts(name)
 	for _, hostLine := range hostsLines {
 		if hostLine.isIpv6 {
 			ipv6List = append(ipv6List, hostLine.ip)
@@ -55,26 +152,30 @@ func (h *Hosts) Find(name string) (ipv4List []net.IP, ipv6List []net.IP) {
 	return ipv4List, ipv6List
 }
 
-func (h *Hosts) initHosts() error {
-	f, err := os.Open(h.filePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	defer log.Debugf("%s took %s", "Load hosts", time.Since(time.Now()))
+// FindReverse returns the names of ip, the first one is its canonical name.
+func (h *Hosts) FindReverse(ip net.IP) []string {
+	return h.current().reverse[ip.String()]
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if err := h.parseLine(scanner.Text()); err != nil {
-			log.Warnf("Bad formatted hosts file line: %s", err)
+// parse builds the table of the last loaded content of the sources with finder
+func (h *Hosts) parse(finder finder.Finder) *table {
+	defer func(start time.Time) { log.Debugf("%s took %s", "Load hosts", time.Since(start)) }(time.Now())
+
+	t := &table{finder: finder, reverse: make(map[string][]string)}
+	for _, s := range h.sources {
+		scanner := bufio.NewScanner(bytes.NewReader(s.data))
+		for scanner.Scan() {
+			if err := t.parseLine(scanner.Text()); err != nil {
+				log.Warnf("Bad formatted hosts file line: %s", err)
+			}
 		}
 	}
-	return nil
+	return t
 }
 
-func (h *Hosts) findHosts(name string) []hostsLine {
+func (t *table) findHosts(name string) []hostsLine {
 	var result []hostsLine
-	ips := h.finder.Get(name)
+	ips := t.finder.Get(name)
 	for _, ipString := range ips {
 		ip := net.ParseIP(ipString)
 		var isIPv6 bool
@@ -96,45 +197,36 @@ func (h *Hosts) findHosts(name string) []hostsLine {
 	return result
 }
 
-func (h *Hosts) parseLine(line string) error {
-	if len(line) == 0 {
-		return nil
+func (t *table) parseLine(line string) error {
+	// Everything after # is a comment
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
 	}
 
-	// Parse leading # for disabled lines
-	if line[0:1] == "#" {
+	// Break line into words, the first one is the ip and the others are its names
+	words := strings.Fields(line)
+	if len(words) == 0 {
 		return nil
 	}
-
-	// Parse other #s for actual comments
-	line = strings.Split(line, "#")[0]
-
-	// Replace tabs and spaces with single spaces throughout
-	line = strings.Replace(line, "\t", " ", -1)
-	for strings.Contains(line, "  ") {
-		line = strings.Replace(line, "  ", " ", -1)
-	}
-
-	line = strings.TrimSpace(line)
-
-	// Break line into words
-	words := strings.Split(line, " ")
-
 	if len(words) < 2 {
-		log.Warn("Wrong format")
-		return &errors.NormalError{Message: "Wrong format"}
-	}
-	for i, word := range words {
-		words[i] = strings.TrimSpace(word)
+		return &errors.NormalError{Message: "Wrong format: " + line}
 	}
-	// Separate the first bit (the ip) from the other bits (the domains)
-	a, host := words[0], words[1]
 
-	ip := net.ParseIP(a)
+	ip := net.ParseIP(words[0])
+	if ip == nil {
+		return &errors.NormalError{Message: "Invalid IP address: " + words[0]}
+	}
 
-	err := h.finder.Insert(host, ip.String())
-	if err != nil {
-		return err
+	for _, host := range words[1:] {
+		host = strings.ToLower(host)
+		// A bad name is skipped alone, the other names of the line are still inserted
+		if err := t.finder.Insert(host, ip.String()); err != nil {
+			log.Warnf("Bad name %s in hosts file line: %s", host, err)
+			continue
+		}
+		if !strings.ContainsAny(host, "*^$\\[]()+?|{}") {
+			t.reverse[ip.String()] = append(t.reverse[ip.String()], host)
+		}
 	}
 	return nil
 }
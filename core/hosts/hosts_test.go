@@ -1,12 +1,21 @@
 package hosts
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/shawn1m/overture/core/finder"
 	"github.com/shawn1m/overture/core/finder/full"
+	"github.com/shawn1m/overture/core/finder/suffix"
 )
 
 func TestHosts_Find(t *testing.T) {
@@ -46,6 +55,101 @@ func TestHosts_Find(t *testing.T) {
 	}
 }
 
+func TestHosts_Aliases(t *testing.T) {
+	hostLinesString := []string{"# generated\n", "127.0.0.1\tlocalhost  foo Bar # loopback\n", "\n",
+		"192.168.1.1 *.lan.example router.lan.example\n", "192.168.1.2 nas.lan.example#storage\n", "bad\n",
+		"192.168.1.3 printer.lan.example *.*.bad.example scanner.lan.example\n"}
+	hostsFile, err := generateHostsFile(hostLinesString)
+	if err != nil {
+		t.Error(err)
+	}
+
+	hosts, err := New(hostsFile, suffix.NewTree())
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"localhost", "foo", "bar."} {
+		if ipv4List, _ := hosts.Find(name); len(ipv4List) != 1 || !find(ipv4List, net.ParseIP("127.0.0.1")) {
+			t.Errorf("%s should be found by alias, got %v", name, ipv4List)
+		}
+	}
+	if ipv4List, _ := hosts.Find("loopback"); len(ipv4List) != 0 {
+		t.Error("comment should not be parsed as name")
+	}
+
+	for name, ip := range map[string]string{
+		"router.lan.example":  "192.168.1.1",
+		"a.b.lan.example":     "192.168.1.1",
+		"nas.lan.example":     "192.168.1.2",
+		"printer.lan.example": "192.168.1.3",
+		"scanner.lan.example": "192.168.1.3",
+	} {
+		if ipv4List, _ := hosts.Find(name); len(ipv4List) != 1 || !find(ipv4List, net.ParseIP(ip)) {
+			t.Errorf("%s should be %s, got %v", name, ip, ipv4List)
+		}
+	}
+	if ipv4List, _ := hosts.Find("lan.example"); len(ipv4List) != 0 {
+		t.Error("wildcard should not match its parent")
+	}
+
+	if names := hosts.FindReverse(net.ParseIP("127.0.0.1")); len(names) != 3 || names[0] != "localhost" {
+		t.Errorf("unexpected reverse names %v", names)
+	}
+	if names := hosts.FindReverse(net.ParseIP("192.168.1.1")); len(names) != 1 || names[0] != "router.lan.example" {
+		t.Errorf("wildcard should not be a reverse name, got %v", names)
+	}
+}
+
+func TestHosts_Reload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("192.168.1.1 a.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".b"), []byte("192.168.1.2 b.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var remote atomic.Value
+	remote.Store("192.168.1.3 c.lan\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf("%q", remote.Load())
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, remote.Load().(string))
+	}))
+	defer srv.Close()
+
+	newFinder := func() finder.Finder { return &full.Map{DataMap: make(map[string][]string)} }
+	hosts := Load([]string{dir, srv.URL, filepath.Join(dir, "missing")}, newFinder, 10*time.Millisecond)
+	for name, want := range map[string]int{"a.lan": 1, "b.lan": 0, "c.lan": 1} {
+		if ipv4List, _ := hosts.Find(name); len(ipv4List) != want {
+			t.Errorf("%s: found %v", name, ipv4List)
+		}
+	}
+
+	hosts.Start()
+	defer hosts.Stop()
+	if err := os.WriteFile(filepath.Join(dir, "d"), []byte("192.168.1.4 d.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remote.Store("192.168.1.5 c.lan\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ipv4List, _ := hosts.Find("c.lan")
+		ipv4Reloaded, _ := hosts.Find("d.lan")
+		if len(ipv4Reloaded) == 1 && find(ipv4List, net.ParseIP("192.168.1.5")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hosts should be reloaded on change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func generateHostsFile(hostLinesString []string) (string, error) {
 
 	var f *os.File
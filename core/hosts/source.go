@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package hosts
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// source is a hosts file, a directory of hosts files or an HTTP(S) URL of a hosts file
+type source struct {
+	location string
+	// version identifies the loaded content: size and modification times of files, or the validator of a URL
+	version string
+	data    []byte
+	// err is the last error of polling, which is logged only when it changes
+	err error
+}
+
+func newSource(location string) *source {
+	return &source{location: location}
+}
+
+// pollChanged is poll which returns only the errors different from the last one
+func (s *source) pollChanged() (bool, error) {
+	changed, err := s.poll()
+	last := s.err
+	s.err = err
+	if err != nil && last != nil && err.Error() == last.Error() {
+		return changed, nil
+	}
+	return changed, err
+}
+
+func (s *source) isURL() bool {
+	return strings.HasPrefix(s.location, "http://") || strings.HasPrefix(s.location, "https://")
+}
+
+// poll loads the content of the source if it has changed since the last poll, and reports whether it has.
+func (s *source) poll() (bool, error) {
+	if s.isURL() {
+		return s.pollURL()
+	}
+
+	files, version, err := s.stat()
+	if err != nil {
+		return false, err
+	}
+	if version == s.version {
+		return false, nil
+	}
+
+	var data []byte
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		data = append(append(data, b...), '\n')
+	}
+	s.version, s.data = version, data
+	return true, nil
+}
+
+// stat returns the files of the source and their version
+func (s *source) stat() ([]string, string, error) {
+	info, err := os.Stat(s.location)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		return []string{s.location}, fileVersion(info), nil
+	}
+
+	entries, err := ioutil.ReadDir(s.location)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var files []string
+	var version strings.Builder
+	for _, e := range entries {
+		// Hidden files and backups of editors are not hosts files
+		if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), "~") {
+			continue
+		}
+		files = append(files, filepath.Join(s.location, e.Name()))
+		version.WriteString(e.Name() + " " + fileVersion(e) + "\n")
+	}
+	return files, version.String(), nil
+}
+
+func fileVersion(info os.FileInfo) string {
+	return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+}
+
+// pollURL fetches the URL with the validators of the last response, an unchanged body is not a change
+// for servers without validators.
+func (s *source) pollURL() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.location, nil)
+	if err != nil {
+		return false, err
+	}
+	if s.data != nil {
+		if strings.HasPrefix(s.version, "W/") || strings.HasPrefix(s.version, `"`) {
+			req.Header.Set("If-None-Match", s.version)
+		} else if s.version != "" {
+			req.Header.Set("If-Modified-Since", s.version)
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	s.version = resp.Header.Get("ETag")
+	if s.version == "" {
+		s.version = resp.Header.Get("Last-Modified")
+	}
+	if s.data != nil && bytes.Equal(data, s.data) {
+		return false, nil
+	}
+	s.data = data
+	return true, nil
+}
@@ -19,12 +19,16 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/doh"
 	"github.com/coredns/coredns/plugin/pkg/response"
 	"github.com/miekg/dns"
+	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core/outbound"
 )
 
+// transferEnvelopeSize is the number of records in every message of an outgoing zone transfer
+const transferEnvelopeSize = 100
+
 type Server struct {
 	bindAddress      string
 	debugHttpAddress string
@@ -34,15 +38,17 @@ type Server struct {
 	ctx              context.Context
 	cancel           context.CancelFunc
 	dohEnabled       bool
+	tsigSecret       map[string]string
 }
 
-func NewServer(bindAddress string, debugHTTPAddress string, dispatcher outbound.Dispatcher, rejectQType []uint16, dohEnabled bool) *Server {
+func NewServer(bindAddress string, debugHTTPAddress string, dispatcher outbound.Dispatcher, rejectQType []uint16, dohEnabled bool, tsigSecret map[string]string) *Server {
 	s := &Server{
 		bindAddress:      bindAddress,
 		debugHttpAddress: debugHTTPAddress,
 		dispatcher:       dispatcher,
 		rejectQType:      rejectQType,
 		dohEnabled:       dohEnabled,
+		tsigSecret:       tsigSecret,
 	}
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.HTTPMux = http.NewServeMux()
@@ -67,7 +73,7 @@ func (s *Server) ServeDNSHttp(w http.ResponseWriter, r *http.Request) {
 	if net.ParseIP(forwardIP) != nil && common.ReservedIPNetworkList.Contains(net.ParseIP(inboundIP), false, "") {
 		inboundIP = forwardIP
 	}
-	log.Debugf("Question from %s: %s", inboundIP, q.Question[0].String())
+	log.Debugf("Question from %s: %s", s.clientName(inboundIP), q.Question[0].String())
 
 	for _, qt := range s.rejectQType {
 		if isQuestionType(q, qt) {
@@ -77,7 +83,7 @@ func (s *Server) ServeDNSHttp(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	responseMessage := s.dispatcher.Exchange(q, inboundIP)
+	responseMessage := s.dispatcher.Exchange(r.Context(), q, inboundIP)
 
 	if responseMessage == nil {
 		http.Error(w, "No response", http.StatusInternalServerError)
@@ -111,7 +117,7 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 	}
 
 	type response struct {
-		Length   int                  `json:"length"`
+		cache.Stats
 		Capacity int                  `json:"capacity"`
 		Body     map[string][]*answer `json:"body"`
 	}
@@ -122,7 +128,7 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 		nobody = false
 	}
 
-	rs, l := s.dispatcher.Cache.Dump(nobody)
+	rs, _ := s.dispatcher.Cache.Dump(nobody)
 	body := make(map[string][]*answer)
 
 	for k, es := range rs {
@@ -142,8 +148,8 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 	}
 
 	res := response{
+		Stats:    s.dispatcher.Cache.Stats(),
 		Body:     body,
-		Length:   l,
 		Capacity: s.dispatcher.Cache.Capacity(),
 	}
 
@@ -156,6 +162,52 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, string(responseBytes))
 }
 
+// Explain reports how a question would be dispatched, available query arguments are
+// `name`, `type` (A by default) and `client` (the inbound IP)
+func (s *Server) Explain(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := query.Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, "invalid type: "+t, http.StatusBadRequest)
+			return
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+
+	var e *outbound.Explanation
+	for _, qt := range s.rejectQType {
+		if isQuestionType(q, qt) {
+			e = &outbound.Explanation{
+				Name:   q.Question[0].Name,
+				Type:   dns.TypeToString[qtype],
+				Client: query.Get("client"),
+				Stage:  "reject",
+				Reason: "Query type is in rejectQType",
+			}
+		}
+	}
+	if e == nil {
+		e = s.dispatcher.Explain(req.Context(), q, query.Get("client"))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	responseBytes, err := json.Marshal(e)
+	if err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Write(responseBytes)
+}
+
 func (s *Server) Run() {
 
 	mux := dns.NewServeMux()
@@ -170,7 +222,7 @@ func (s *Server) Run() {
 		go func(p string) {
 
 			// Manual create server inorder to have a way to close it.
-			srv := &dns.Server{Addr: s.bindAddress, Net: p, Handler: mux}
+			srv := &dns.Server{Addr: s.bindAddress, Net: p, Handler: mux, TsigSecret: s.tsigSecret}
 			go func() {
 				<-s.ctx.Done()
 				log.Warnf("Shutting down the server on protocol %s", p)
@@ -187,6 +239,7 @@ func (s *Server) Run() {
 
 	if s.debugHttpAddress != "" {
 		s.HTTPMux.HandleFunc("/cache", s.DumpCache)
+		s.HTTPMux.HandleFunc("/explain", s.Explain)
 		s.HTTPMux.HandleFunc("/debug/pprof/", pprof.Index)
 		s.HTTPMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 		s.HTTPMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -226,10 +279,27 @@ func (s *Server) Stop() {
 	s.cancel()
 }
 
+// clientName returns the address of the client with the hostname of its DHCP lease if there is one
+func (s *Server) clientName(inboundIP string) string {
+	if hostname := s.dispatcher.Leases.Hostname(net.ParseIP(inboundIP)); hostname != "" {
+		return inboundIP + " (" + hostname + ")"
+	}
+	return inboundIP
+}
+
 func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	inboundIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
 
-	log.Debugf("Question from %s: %s", inboundIP, q.Question[0].String())
+	switch q.Opcode {
+	case dns.OpcodeUpdate:
+		s.serveUpdate(w, q, inboundIP)
+		return
+	case dns.OpcodeNotify:
+		s.serveNotify(w, q, inboundIP)
+		return
+	}
+
+	log.Debugf("Question from %s: %s", s.clientName(inboundIP), q.Question[0].String())
 
 	for _, qt := range s.rejectQType {
 		if isQuestionType(q, qt) {
@@ -239,7 +309,12 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 		}
 	}
 
-	responseMessage := s.dispatcher.Exchange(q, inboundIP)
+	if isQuestionType(q, dns.TypeAXFR) || isQuestionType(q, dns.TypeIXFR) {
+		s.serveTransfer(w, q, inboundIP)
+		return
+	}
+
+	responseMessage := s.dispatcher.Exchange(s.ctx, q, inboundIP)
 
 	if responseMessage == nil {
 		dns.HandleFailed(w, q)
@@ -253,4 +328,76 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	}
 }
 
+// serveUpdate applies a dynamic update (RFC 2136) to a local zone, the update must be signed
+// by a TSIG key allowed by the zone
+func (s *Server) serveUpdate(w dns.ResponseWriter, q *dns.Msg, inboundIP string) {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+
+	tsig := q.IsTsig()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeSOA {
+		resp.Rcode = dns.RcodeFormatError
+	} else if z := s.dispatcher.Zones.Get(q.Question[0].Name); z == nil {
+		log.Debugf("Reject update from %s: %s is not a local zone", inboundIP, q.Question[0].Name)
+		resp.Rcode = dns.RcodeNotAuth
+	} else if tsig == nil || !z.UpdateAllowed(tsig.Hdr.Name) {
+		log.Warnf("Reject update of zone %s from %s: not signed by an allowed TSIG key", z.Origin, inboundIP)
+		resp.Rcode = dns.RcodeRefused
+	} else if err := w.TsigStatus(); err != nil {
+		log.Warnf("Reject update of zone %s from %s: %s", z.Origin, inboundIP, err)
+		resp.Rcode = dns.RcodeNotAuth
+		tsig = nil
+	} else {
+		resp.Rcode = z.Update(q)
+		log.Infof("Update of zone %s from %s with key %s: %s", z.Origin, inboundIP, tsig.Hdr.Name, dns.RcodeToString[resp.Rcode])
+	}
+
+	if tsig != nil && w.TsigStatus() == nil {
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		log.Warnf("Write message failed, message: %s, error: %s", resp, err)
+	}
+}
+
+// serveNotify refreshes a secondary zone on NOTIFY (RFC 1996) from its primary server
+func (s *Server) serveNotify(w dns.ResponseWriter, q *dns.Msg, inboundIP string) {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Authoritative = true
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeSOA {
+		resp.Rcode = dns.RcodeFormatError
+	} else if !s.dispatcher.Zones.Notify(q.Question[0].Name, net.ParseIP(inboundIP)) {
+		log.Debugf("Reject NOTIFY from %s: %s is not a secondary zone of it", inboundIP, q.Question[0].Name)
+		resp.Rcode = dns.RcodeRefused
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		log.Warnf("Write message failed, message: %s, error: %s", resp, err)
+	}
+}
+
+// serveTransfer sends a local zone to the client by AXFR over TCP, IXFR is answered by AXFR as well
+func (s *Server) serveTransfer(w dns.ResponseWriter, q *dns.Msg, inboundIP string) {
+	z := s.dispatcher.Zones.Get(q.Question[0].Name)
+	if z == nil || w.RemoteAddr().Network() != "tcp" || !z.TransferAllowed(net.ParseIP(inboundIP)) {
+		log.Debugf("Refuse transfer of %s to %s", q.Question[0].Name, inboundIP)
+		resp := new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeRefused)
+		w.WriteMsg(resp)
+		return
+	}
+
+	envelopes := z.Envelopes(transferEnvelopeSize)
+	ch := make(chan *dns.Envelope, len(envelopes))
+	for _, e := range envelopes {
+		ch <- e
+	}
+	close(ch)
+	if err := new(dns.Transfer).Out(w, q, ch); err != nil {
+		log.Warnf("Transfer of zone %s to %s failed: %s", z.Origin, inboundIP, err)
+		return
+	}
+	log.Infof("Zone %s has been transferred to %s", z.Origin, inboundIP)
+}
+
 func isQuestionType(q *dns.Msg, qt uint16) bool { return q.Question[0].Qtype == qt }
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+// Package leases provides address lookups of local hostnames from DHCP lease files.
+package leases
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTTL is the TTL of answers from leases unless it is configured
+const DefaultTTL = 60
+
+// Lease is an address leased to a host
+type Lease struct {
+	Hostname string
+	IP       net.IP
+	// Expiry is zero for infinite leases
+	Expiry time.Time
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return !l.Expiry.IsZero() && now.After(l.Expiry)
+}
+
+// File is a lease file of the DHCP server Format, which is one of "dnsmasq", "isc" and "kea"
+type File struct {
+	Path   string
+	Format string
+
+	version string
+	leases  []*Lease
+}
+
+// Leases answers "<hostname>.<Domain>" with the addresses leased to hostname, and the reverse names of
+// the addresses with it.
+type Leases struct {
+	Domain string
+	// TTL of the answers from leases
+	TTL uint32
+
+	files    []*File
+	interval time.Duration
+	// table is the current *table, which is replaced as a whole on reload
+	table atomic.Value
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+}
+
+type table struct {
+	byName map[string][]*Lease
+	byIP   map[string]*Lease
+}
+
+// Load reads the lease files, files failing to load are logged and skipped. After Start, files are checked
+// every interval and reloaded when any of them changes.
+func Load(files []*File, domain string, interval time.Duration) *Leases {
+	l := &Leases{Domain: dns.CanonicalName(domain), TTL: DefaultTTL, files: files, interval: interval}
+	l.reload()
+	return l
+}
+
+// reload parses the changed files and reports whether any file has changed
+func (l *Leases) reload() bool {
+	changed := false
+	for _, f := range l.files {
+		c, err := f.load()
+		if err != nil {
+			log.Warnf("Failed to load DHCP leases from %s: %s", f.Path, err)
+		}
+		changed = changed || c
+	}
+	if changed || l.table.Load() == nil {
+		l.table.Store(l.build())
+	}
+	return changed
+}
+
+// build indexes the leases of all files, later leases of the same address replace earlier ones
+func (l *Leases) build() *table {
+	t := &table{byName: make(map[string][]*Lease), byIP: make(map[string]*Lease)}
+	for _, f := range l.files {
+		for _, lease := range f.leases {
+			t.byIP[lease.IP.String()] = lease
+		}
+	}
+	for _, lease := range t.byIP {
+		t.byName[lease.Hostname] = append(t.byName[lease.Hostname], lease)
+	}
+	return t
+}
+
+// Start starts checking the files for changes until Stop is called.
+func (l *Leases) Start() {
+	if l == nil || l.interval <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cancel != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if l.reload() {
+					log.Info("DHCP leases have been reloaded")
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops checking the files for changes.
+func (l *Leases) Stop() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cancel != nil {
+		l.cancel()
+		l.cancel = nil
+	}
+}
+
+func (l *Leases) current() *table {
+	return l.table.Load().(*table)
+}
+
+// Find returns the addresses leased to the host of name, which must be in the local domain.
+func (l *Leases) Find(name string) (ipv4List []net.IP, ipv6List []net.IP) {
+	if l == nil {
+		return nil, nil
+	}
+	name = dns.CanonicalName(name)
+	hostname := strings.TrimSuffix(name, "."+l.Domain)
+	if hostname == name || strings.Contains(hostname, ".") {
+		return nil, nil
+	}
+	now := time.Now()
+	for _, lease := range l.current().byName[hostname] {
+		if lease.expired(now) {
+			continue
+		}
+		if lease.IP.To4() != nil {
+			ipv4List = append(ipv4List, lease.IP)
+		} else {
+			ipv6List = append(ipv6List, lease.IP)
+		}
+	}
+	return ipv4List, ipv6List
+}
+
+// Hostname returns the hostname which ip is leased to, or "".
+func (l *Leases) Hostname(ip net.IP) string {
+	if l == nil || ip == nil {
+		return ""
+	}
+	lease, ok := l.current().byIP[ip.String()]
+	if !ok || lease.expired(time.Now()) {
+		return ""
+	}
+	return lease.Hostname
+}
+
+// FindReverse returns the name in the local domain of the host which ip is leased to, or "".
+func (l *Leases) FindReverse(ip net.IP) string {
+	if hostname := l.Hostname(ip); hostname != "" {
+		return hostname + "." + l.Domain
+	}
+	return ""
+}
+
+// load parses the file if it has changed since the last load, and reports whether it has.
+func (f *File) load() (bool, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return false, err
+	}
+	version := fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+	if version == f.version {
+		return false, nil
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var leases []*Lease
+	switch f.Format {
+	case "dnsmasq":
+		leases, err = parseDnsmasq(file)
+	case "isc":
+		leases, err = parseISC(file)
+	case "kea":
+		leases, err = parseKea(file)
+	default:
+		err = fmt.Errorf("unknown lease file format %s", f.Format)
+	}
+	if err != nil {
+		return false, err
+	}
+	f.version, f.leases = version, leases
+	return true, nil
+}
+
+// hostname returns the first label of name in lower case if it is a valid hostname, or ""
+func hostname(name string) string {
+	name = strings.ToLower(strings.Trim(name, `".`))
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || name == "*" {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return ""
+	}
+	return name
+}
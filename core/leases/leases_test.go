@@ -0,0 +1,71 @@
+package leases
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	dnsmasq := write("dnsmasq.leases", strconv.FormatInt(future.Unix(), 10)+" aa:bb:cc:dd:ee:01 192.168.1.10 Laptop 01:aa:bb:cc:dd:ee:01\n"+
+		"0 aa:bb:cc:dd:ee:02 192.168.1.11 * *\n"+
+		"1 aa:bb:cc:dd:ee:03 192.168.1.12 old *\n"+
+		"duid 00:01:00:01:aa:bb:cc:dd\n"+
+		"0 1234 fd00::10 laptop 00:01:00:01:aa:bb:cc:dd\n")
+	isc := write("dhcpd.leases", `
+lease 192.168.2.10 {
+  ends epoch 1; # expired
+  binding state active;
+  client-hostname "printer";
+}
+lease 192.168.2.10 {
+  ends never;
+  binding state active;
+  client-hostname "printer";
+}
+lease 192.168.2.11 {
+  ends never;
+  binding state free;
+  client-hostname "phone";
+}
+`)
+	kea := write("kea-leases4.csv", "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state\n"+
+		"192.168.3.10,aa:bb:cc:dd:ee:04,,3600,"+strconv.FormatInt(future.Unix(), 10)+",1,0,0,nas.lan,0\n"+
+		"192.168.3.11,aa:bb:cc:dd:ee:05,,3600,"+strconv.FormatInt(future.Unix(), 10)+",1,0,0,tv,1\n")
+
+	l := Load([]*File{{Path: dnsmasq, Format: "dnsmasq"}, {Path: isc, Format: "isc"}, {Path: kea, Format: "kea"}}, "lan", 0)
+
+	if v4, v6 := l.Find("laptop.lan."); len(v4) != 1 || len(v6) != 1 || !v4[0].Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("unexpected addresses of laptop %v %v", v4, v6)
+	}
+	for _, name := range []string{"printer.lan", "nas.lan"} {
+		if v4, _ := l.Find(name); len(v4) != 1 {
+			t.Errorf("%s should have an address", name)
+		}
+	}
+	for _, name := range []string{"old.lan", "phone.lan", "tv.lan", "laptop.example", "laptop"} {
+		if v4, v6 := l.Find(name); len(v4) != 0 || len(v6) != 0 {
+			t.Errorf("%s should have no address", name)
+		}
+	}
+
+	if name := l.FindReverse(net.ParseIP("fd00::10")); name != "laptop.lan." {
+		t.Errorf("unexpected reverse name %q", name)
+	}
+	if hostname := l.Hostname(net.ParseIP("192.168.2.11")); hostname != "" {
+		t.Errorf("released lease should have no hostname, got %q", hostname)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package leases
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// released is the expiry of leases which are no longer active, they replace the earlier leases of the address
+var released = time.Unix(1, 0)
+
+// parseDnsmasq parses the lease file of dnsmasq, lines are "<expiry> <MAC or IAID> <ip> <hostname> <client id>"
+// and hostname is "*" if it is unknown.
+func parseDnsmasq(r io.Reader) ([]*Lease, error) {
+	var leases []*Lease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		name := hostname(fields[3])
+		if err != nil || ip == nil || name == "" {
+			continue
+		}
+		lease := &Lease{Hostname: name, IP: ip}
+		if expiry != 0 {
+			lease.Expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseISC parses the IPv4 leases of dhcpd.leases of ISC dhcpd, which are blocks like
+// `lease <ip> { ends <weekday> <date> <time>; binding state active; client-hostname "<hostname>"; }`.
+func parseISC(r io.Reader) ([]*Lease, error) {
+	var leases []*Lease
+	var lease *Lease
+	active := true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "lease" && len(fields) >= 2:
+			lease, active = &Lease{IP: net.ParseIP(fields[1])}, true
+		case lease == nil:
+		case fields[0] == "}":
+			if lease.IP != nil && lease.Hostname != "" {
+				if !active {
+					lease.Expiry = released
+				}
+				leases = append(leases, lease)
+			}
+			lease = nil
+		case fields[0] == "ends":
+			lease.Expiry = parseISCTime(fields[1:])
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			lease.Hostname = hostname(fields[1])
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// parseISCTime parses "<weekday> <yyyy/mm/dd> <hh:mm:ss>" in UTC, "epoch <seconds>" or "never"
+func parseISCTime(fields []string) time.Time {
+	switch {
+	case len(fields) == 2 && fields[0] == "epoch":
+		if seconds, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return time.Unix(seconds, 0)
+		}
+	case len(fields) == 3:
+		if t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseKea parses the CSV lease file of the memfile backend of Kea for both IPv4 and IPv6, whose columns
+// are named by the header line.
+func parseKea(r io.Reader) ([]*Lease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.New("no column " + name + " in Kea lease file")
+		}
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var leases []*Lease
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(column(record, "address"))
+		name := hostname(column(record, "hostname"))
+		expire, err := strconv.ParseInt(column(record, "expire"), 10, 64)
+		if ip == nil || name == "" || err != nil {
+			continue
+		}
+		lease := &Lease{Hostname: name, IP: ip, Expiry: time.Unix(expire, 0)}
+		// Leases of other states than default, and leases of zero lifetime, have been released
+		if state := column(record, "state"); (state != "" && state != "0") || column(record, "valid_lifetime") == "0" {
+			lease.Expiry = released
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
@@ -17,6 +17,10 @@ func (s *Default) Has(str string) bool {
 	return true
 }
 
+func (s *Default) Match(str string) (string, bool) {
+	return "final", true
+}
+
 func (s *Default) Name() string {
 	return "final"
 }
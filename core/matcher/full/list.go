@@ -16,12 +16,17 @@ func (s *List) Insert(str string) error {
 }
 
 func (s *List) Has(str string) bool {
+	_, ok := s.Match(str)
+	return ok
+}
+
+func (s *List) Match(str string) (string, bool) {
 	for _, data := range s.DataList {
 		if data == str {
-			return true
+			return data, true
 		}
 	}
-	return false
+	return "", false
 }
 
 func (s *List) Name() string {
@@ -22,6 +22,13 @@ func (m *Map) Has(str string) bool {
 	return false
 }
 
+func (m *Map) Match(str string) (string, bool) {
+	if m.Has(str) {
+		return str, true
+	}
+	return "", false
+}
+
 func (m *Map) Name() string {
 	return "full-map"
 }
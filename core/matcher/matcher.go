@@ -9,5 +9,7 @@ package matcher
 type Matcher interface {
 	Insert(string) error
 	Has(string) bool
+	// Match is like Has, but also returns the rule which matched
+	Match(string) (string, bool)
 	Name() string
 }
@@ -43,32 +43,38 @@ func (s *List) Insert(str string) error {
 }
 
 func (s *List) Has(str string) bool {
+	_, ok := s.Match(str)
+	return ok
+}
+
+func (s *List) Match(str string) (string, bool) {
 	for _, data := range s.DataList {
+		rule := data.Type + ":" + data.Content
 		switch data.Type {
 		case "domain":
 			idx := len(str) - len(data.Content)
 			if idx >= 0 && data.Content == str[idx:] {
 				if idx >= 1 && (str[idx-1] != '.') {
-					return false
+					return "", false
 				}
-				return true
+				return rule, true
 			}
 		case "regex":
 			reg := regexp.MustCompile(data.Content)
 			if reg.MatchString(str) {
-				return true
+				return rule, true
 			}
 		case "keyword":
 			if strings.Contains(str, data.Content) {
-				return true
+				return rule, true
 			}
 		case "full":
 			if data.Content == str {
-				return true
+				return rule, true
 			}
 		}
 	}
-	return false
+	return "", false
 }
 
 func (s *List) Name() string {
@@ -18,12 +18,17 @@ func (r *List) Insert(s string) error {
 }
 
 func (r *List) Has(s string) bool {
+	_, ok := r.Match(s)
+	return ok
+}
+
+func (r *List) Match(s string) (string, bool) {
 	for _, regex := range r.RegexList {
 		if common.IsDomainMatchRule(regex, s) {
-			return true
+			return regex, true
 		}
 	}
-	return false
+	return "", false
 }
 
 func (r *List) Name() string {
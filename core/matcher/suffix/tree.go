@@ -69,6 +69,29 @@ func (dt *Tree) Has(d string) bool {
 	return dt.has(Domain(d))
 }
 
+// match is like has, but also returns the matched suffix built from the levels visited so far.
+func (dt *Tree) match(d Domain, suffix string) (string, bool) {
+	if len(dt.sub) == 0 || dt.final {
+		return suffix, true
+	}
+
+	top := d.topLevel()
+	if sub, ok := dt.sub[top]; ok {
+		if suffix != "" {
+			suffix = "." + suffix
+		}
+		return sub.match(d.nextLevel(), string(top)+suffix)
+	}
+	return "", false
+}
+
+func (dt *Tree) Match(d string) (string, bool) {
+	if len(dt.sub) == 0 {
+		return "", false
+	}
+	return dt.match(Domain(d), "")
+}
+
 func (dt *Tree) insert(sections []Domain) {
 
 	if len(sections) == 0 {
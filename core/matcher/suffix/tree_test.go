@@ -32,3 +32,19 @@ func TestTree_Has(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTree_Match(t *testing.T) {
+	tree := DefaultDomainTree()
+	tree.Insert("abc.com")
+	tree.Insert("1.xyz.com")
+
+	if rule, ok := tree.Match("1.2.abc.com"); !ok || rule != "abc.com" {
+		t.Errorf("got %q %v, want abc.com", rule, ok)
+	}
+	if rule, ok := tree.Match("1.xyz.com"); !ok || rule != "1.xyz.com" {
+		t.Errorf("got %q %v, want 1.xyz.com", rule, ok)
+	}
+	if _, ok := tree.Match("xyz.com"); ok {
+		t.Error("xyz.com should not match")
+	}
+}
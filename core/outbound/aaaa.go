@@ -0,0 +1,64 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/policy"
+)
+
+func (d *Dispatcher) aaaaAction(query *dns.Msg, inboundIP string) string {
+	if len(d.AAAAPolicy) == 0 {
+		return policy.AAAAForward
+	}
+	name := query.Question[0].Name
+	return d.AAAAPolicy.Action(name[:len(name)-1], net.ParseIP(inboundIP))
+}
+
+// exchangeByAAAAPolicy answers AAAA questions with empty NODATA if the AAAA policy action
+// requires so, otherwise nil is returned. Local zones and hosts are always respected.
+func (d *Dispatcher) exchangeByAAAAPolicy(ctx context.Context, query *dns.Msg, inboundIP string, action string) *dns.Msg {
+	if query.Question[0].Qtype != dns.TypeAAAA {
+		return nil
+	}
+
+	switch action {
+	case policy.AAAANoData:
+	case policy.AAAAPreferIPv4:
+		q := query.Copy()
+		q.Question[0].Qtype = dns.TypeA
+		if !hasRecord(d.exchange(ctx, q, inboundIP), dns.TypeA) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if resp := d.exchangeZone(ctx, query, inboundIP); resp != nil {
+		return resp
+	}
+	localClient := d.newLocalClient(query)
+	if resp := localClient.Exchange(); resp != nil {
+		return resp
+	}
+	log.Debugf("AAAA policy %s: answer %s with NODATA", action, query.Question[0].Name)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.RecursionAvailable = true
+	return resp
+}
+
+func hasRecord(m *dns.Msg, t uint16) bool {
+	if m == nil {
+		return false
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
@@ -12,19 +12,20 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core/cache"
+	"github.com/shawn1m/overture/core/common"
 )
 
 type CacheClient struct {
 	responseMessage *dns.Msg
 	questionMessage *dns.Msg
 
-	ednsClientSubnetIP string
+	ednsClientSubnet string
 
 	cache *cache.Cache
 }
 
-func NewCacheClient(q *dns.Msg, ip string, cache *cache.Cache) *CacheClient {
-	return &CacheClient{questionMessage: q.Copy(), ednsClientSubnetIP: ip, cache: cache}
+func NewCacheClient(q *dns.Msg, subnet string, cache *cache.Cache) *CacheClient {
+	return &CacheClient{questionMessage: q.Copy(), ednsClientSubnet: subnet, cache: cache}
 }
 
 func (c *CacheClient) Exchange() *dns.Msg {
@@ -40,12 +41,40 @@ func (c *CacheClient) exchangeFromCache() bool {
 		return false
 	}
 
-	m := c.cache.Hit(cache.Key(c.questionMessage.Question[0], c.ednsClientSubnetIP), c.questionMessage.Id)
+	key := c.cache.MatchKey(c.questionMessage.Question[0], c.ednsClientSubnet)
+	m := c.cache.Hit(key, c.questionMessage.Id)
 	if m != nil {
-		log.Debugf("Cache hit: %s", cache.Key(c.questionMessage.Question[0], c.ednsClientSubnetIP))
+		log.Debugf("Cache hit: %s", key)
 		c.responseMessage = m
 		return true
 	}
 
 	return false
 }
+
+// Peek answers from the cache without counting the lookup, see cache.Cache.Peek.
+func (c *CacheClient) Peek() *dns.Msg {
+	if c.cache == nil {
+		return nil
+	}
+	return c.cache.Peek(c.cache.MatchKey(c.questionMessage.Question[0], c.ednsClientSubnet), c.questionMessage.Id)
+}
+
+// ExchangeStale answers from an expired cache entry, it should only be used when upstreams fail.
+func (c *CacheClient) ExchangeStale() *dns.Msg {
+	if c.cache == nil {
+		return nil
+	}
+
+	key := c.cache.MatchKey(c.questionMessage.Question[0], c.ednsClientSubnet)
+	m := c.cache.Stale(key, c.questionMessage.Id)
+	if m == nil {
+		return nil
+	}
+	log.Debugf("Stale cache hit: %s", key)
+	if c.questionMessage.IsEdns0() != nil {
+		common.SetExtendedError(m, dns.ExtendedErrorCodeStaleAnswer, "")
+	}
+	c.responseMessage = m
+	return c.responseMessage
+}
@@ -10,14 +10,20 @@ package clients
 import (
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/shawn1m/overture/core/common"
 	"github.com/shawn1m/overture/core/hosts"
+	"github.com/shawn1m/overture/core/leases"
+	"github.com/shawn1m/overture/core/records"
 )
 
+// maxLocalCNAMEs is the limit of CNAME records followed in local records
+const maxLocalCNAMEs = 8
+
 type LocalClient struct {
 	responseMessage *dns.Msg
 	questionMessage *dns.Msg
@@ -26,17 +32,23 @@ type LocalClient struct {
 	domainTTLMap map[string]uint32
 
 	hosts   *hosts.Hosts
+	leases  *leases.Leases
+	records *records.Records
 	rawName string
+
+	// specialUseNames answers names in private reverse zones and special-use domains with NXDOMAIN
+	specialUseNames bool
 }
 
-func NewLocalClient(q *dns.Msg, h *hosts.Hosts, minimumTTL int, domainTTLMap map[string]uint32) *LocalClient {
-	c := &LocalClient{questionMessage: q.Copy(), hosts: h, minimumTTL: minimumTTL, domainTTLMap: domainTTLMap}
+func NewLocalClient(q *dns.Msg, h *hosts.Hosts, l *leases.Leases, r *records.Records, minimumTTL int, domainTTLMap map[string]uint32, specialUseNames bool) *LocalClient {
+	c := &LocalClient{questionMessage: q.Copy(), hosts: h, leases: l, records: r, minimumTTL: minimumTTL, domainTTLMap: domainTTLMap,
+		specialUseNames: specialUseNames}
 	c.rawName = c.questionMessage.Question[0].Name
 	return c
 }
 
 func (c *LocalClient) Exchange() *dns.Msg {
-	if c.exchangeFromHosts() || c.exchangeFromIP() {
+	if c.exchangeFromHosts() || c.exchangeFromLeases() || c.exchangeFromRecords() || c.exchangeFromIP() || c.exchangeSpecialUseName() {
 		if c.responseMessage != nil {
 			common.SetMinimumTTL(c.responseMessage, uint32(c.minimumTTL))
 			common.SetTTLByMap(c.responseMessage, c.domainTTLMap)
@@ -52,13 +64,17 @@ func (c *LocalClient) exchangeFromHosts() bool {
 		return false
 	}
 
+	if c.questionMessage.Question[0].Qtype == dns.TypePTR {
+		return c.exchangeReverseFromHosts()
+	}
+
 	name := c.rawName[:len(c.rawName)-1]
 	ipv4List, ipv6List := c.hosts.Find(name)
 
 	if c.questionMessage.Question[0].Qtype == dns.TypeA && len(ipv4List) > 0 {
 		var rrl []dns.RR
 		for _, ip := range ipv4List {
-			a, _ := dns.NewRR(c.rawName + " IN A " + ip.String())
+			a, _ := dns.NewRR(c.rawName + c.hostsTTL() + " IN A " + ip.String())
 			rrl = append(rrl, a)
 		}
 		c.setLocalResponseMessage(rrl)
@@ -68,7 +84,7 @@ func (c *LocalClient) exchangeFromHosts() bool {
 	} else if c.questionMessage.Question[0].Qtype == dns.TypeAAAA && len(ipv6List) > 0 {
 		var rrl []dns.RR
 		for _, ip := range ipv6List {
-			aaaa, _ := dns.NewRR(c.rawName + " IN AAAA " + ip.String())
+			aaaa, _ := dns.NewRR(c.rawName + c.hostsTTL() + " IN AAAA " + ip.String())
 			rrl = append(rrl, aaaa)
 		}
 		c.setLocalResponseMessage(rrl)
@@ -86,6 +102,122 @@ func (c *LocalClient) exchangeFromHosts() bool {
 	return false
 }
 
+func (c *LocalClient) hostsTTL() string {
+	return " " + strconv.FormatUint(uint64(c.hosts.TTL), 10)
+}
+
+func (c *LocalClient) exchangeReverseFromHosts() bool {
+	ip := common.ParseReverseName(c.rawName)
+	if ip == nil {
+		return false
+	}
+	names := c.hosts.FindReverse(ip)
+	if len(names) == 0 {
+		return false
+	}
+
+	var rrl []dns.RR
+	for _, name := range names {
+		ptr, _ := dns.NewRR(c.rawName + c.hostsTTL() + " IN PTR " + dns.Fqdn(name))
+		rrl = append(rrl, ptr)
+	}
+	c.setLocalResponseMessage(rrl)
+	// The first name is the canonical one
+	c.responseMessage.Answer = rrl
+	return true
+}
+
+// exchangeFromLeases answers addresses of hostnames in the local domain and their reverse names from
+// DHCP leases.
+func (c *LocalClient) exchangeFromLeases() bool {
+	if c.leases == nil {
+		return false
+	}
+
+	ttl := " " + strconv.FormatUint(uint64(c.leases.TTL), 10)
+	qtype := c.questionMessage.Question[0].Qtype
+	if qtype == dns.TypePTR {
+		name := c.leases.FindReverse(common.ParseReverseName(c.rawName))
+		if name == "" {
+			return false
+		}
+		ptr, _ := dns.NewRR(c.rawName + ttl + " IN PTR " + name)
+		c.setLocalResponseMessage([]dns.RR{ptr})
+		return true
+	}
+
+	ipv4List, ipv6List := c.leases.Find(c.rawName)
+	if len(ipv4List) == 0 && len(ipv6List) == 0 {
+		return false
+	}
+	var rrl []dns.RR
+	if qtype == dns.TypeA {
+		for _, ip := range ipv4List {
+			a, _ := dns.NewRR(c.rawName + ttl + " IN A " + ip.String())
+			rrl = append(rrl, a)
+		}
+	} else if qtype == dns.TypeAAAA {
+		for _, ip := range ipv6List {
+			aaaa, _ := dns.NewRR(c.rawName + ttl + " IN AAAA " + ip.String())
+			rrl = append(rrl, aaaa)
+		}
+	} else {
+		return false
+	}
+	// Hosts with leases of the other family have no records of the question type
+	c.setLocalResponseMessage(rrl)
+	return true
+}
+
+// exchangeFromRecords answers from local records of the question type, CNAME records are followed
+// in local records. Names with local records of other types only get an empty answer, so that they
+// are never sent upstream.
+func (c *LocalClient) exchangeFromRecords() bool {
+	if c.records == nil {
+		return false
+	}
+	local := len(c.records.Find(c.rawName)) > 0
+
+	qtype := c.questionMessage.Question[0].Qtype
+	var answer []dns.RR
+	name := c.rawName
+	for i := 0; i < maxLocalCNAMEs; i++ {
+		var matched, cnames []dns.RR
+		for _, rr := range c.records.Find(name) {
+			if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+				matched = append(matched, rr)
+			} else if rr.Header().Rrtype == dns.TypeCNAME {
+				cnames = append(cnames, rr)
+			}
+		}
+		if len(matched) > 0 {
+			answer = append(answer, matched...)
+			break
+		}
+		if len(cnames) == 0 {
+			break
+		}
+		answer = append(answer, cnames[0])
+		name = cnames[0].(*dns.CNAME).Target
+	}
+	if len(answer) == 0 && !local {
+		return false
+	}
+
+	c.setLocalResponseMessage(nil)
+	c.responseMessage.Answer = answer
+	return true
+}
+
+func (c *LocalClient) exchangeSpecialUseName() bool {
+	if !c.specialUseNames || !common.IsSpecialUseName(c.rawName) {
+		return false
+	}
+	c.setLocalResponseMessage(nil)
+	c.responseMessage.Rcode = dns.RcodeNameError
+	return true
+}
+
 func (c *LocalClient) exchangeFromIP() bool {
 	name := c.rawName[:len(c.rawName)-1]
 	ip := net.ParseIP(name)
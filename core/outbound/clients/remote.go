@@ -8,6 +8,8 @@
 package clients
 
 import (
+	"context"
+
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"net"
@@ -21,10 +23,10 @@ type RemoteClient struct {
 	responseMessage *dns.Msg
 	questionMessage *dns.Msg
 
-	dnsUpstream        *common.DNSUpstream
-	ednsClientSubnetIP string
-	inboundIP          string
-	dnsResolver        resolver.Resolver
+	dnsUpstream      *common.DNSUpstream
+	ednsClientSubnet string
+	inboundIP        string
+	dnsResolver      resolver.Resolver
 
 	cache *cache.Cache
 }
@@ -32,33 +34,20 @@ type RemoteClient struct {
 func NewClient(q *dns.Msg, u *common.DNSUpstream, resolver resolver.Resolver, ip string, cache *cache.Cache) *RemoteClient {
 	c := &RemoteClient{questionMessage: q.Copy(), dnsUpstream: u, dnsResolver: resolver, inboundIP: ip, cache: cache}
 
+	// The ECS option is set before cache lookups, so that responses are cached by the subnet sent upstream
 	if c.dnsUpstream.EDNSClientSubnet != nil {
-		c.getEDNSClientSubnetIP()
+		c.dnsUpstream.EDNSClientSubnet.Apply(c.questionMessage, net.ParseIP(ip))
+	}
+	c.ednsClientSubnet = common.GetEDNSClientSubnet(c.questionMessage)
+	if c.ednsClientSubnet != "" {
+		log.Debugf("Use %s as ednsClientSubnet of %s", c.ednsClientSubnet, c.dnsUpstream.Name)
 	}
 
 	return c
 }
 
-func (c *RemoteClient) getEDNSClientSubnetIP() {
-	switch c.dnsUpstream.EDNSClientSubnet.Policy {
-	case "auto":
-		if !common.ReservedIPNetworkList.Contains(net.ParseIP(c.inboundIP), false, "") {
-			c.ednsClientSubnetIP = c.inboundIP
-		} else {
-			c.ednsClientSubnetIP = c.dnsUpstream.EDNSClientSubnet.ExternalIP
-		}
-	case "manual":
-		if c.dnsUpstream.EDNSClientSubnet.ExternalIP != "" &&
-			!common.ReservedIPNetworkList.Contains(net.ParseIP(c.dnsUpstream.EDNSClientSubnet.ExternalIP), false, "") {
-			c.ednsClientSubnetIP = c.dnsUpstream.EDNSClientSubnet.ExternalIP
-			return
-		}
-	case "disable":
-	}
-}
-
 func (c *RemoteClient) ExchangeFromCache() *dns.Msg {
-	cacheClient := NewCacheClient(c.questionMessage, c.ednsClientSubnetIP, c.cache)
+	cacheClient := NewCacheClient(c.questionMessage, c.ednsClientSubnet, c.cache)
 	c.responseMessage = cacheClient.Exchange()
 	if c.responseMessage != nil {
 		return c.responseMessage
@@ -66,20 +55,25 @@ func (c *RemoteClient) ExchangeFromCache() *dns.Msg {
 	return nil
 }
 
-func (c *RemoteClient) Exchange(isLog bool) *dns.Msg {
-	common.SetEDNSClientSubnet(c.questionMessage, c.ednsClientSubnetIP,
-		c.dnsUpstream.EDNSClientSubnet.NoCookie)
-	log.Debugf("Use " + c.ednsClientSubnetIP + " as original ednsClientSubnetIP")
-	c.ednsClientSubnetIP = common.GetEDNSClientSubnetIP(c.questionMessage)
-	log.Debugf("Use " + c.ednsClientSubnetIP + " as ednsClientSubnetIP")
+// PeekCache returns the cached response of this client without counting the lookup.
+func (c *RemoteClient) PeekCache() *dns.Msg {
+	return NewCacheClient(c.questionMessage, c.ednsClientSubnet, c.cache).Peek()
+}
+
+func (c *RemoteClient) ExchangeFromStaleCache() *dns.Msg {
+	cacheClient := NewCacheClient(c.questionMessage, c.ednsClientSubnet, c.cache)
+	return cacheClient.ExchangeStale()
+}
 
+func (c *RemoteClient) Exchange(ctx context.Context, isLog bool) *dns.Msg {
 	if c.responseMessage != nil {
 		return c.responseMessage
 	}
 
 	var temp *dns.Msg
 	var err error
-	temp, err = c.dnsResolver.Exchange(c.questionMessage)
+	// Packing changes the OPT record, and the question is still read for stale answers after the deadline
+	temp, err = c.dnsResolver.Exchange(ctx, c.questionMessage.Copy())
 
 	if err != nil {
 		log.Debugf("%s Fail: %s", c.dnsUpstream.Name, err)
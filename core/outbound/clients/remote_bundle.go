@@ -7,12 +7,16 @@
 package clients
 
 import (
+	"context"
+	"strings"
+
 	"github.com/miekg/dns"
 	"github.com/shawn1m/overture/core/outbound/clients/resolver"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/dnssec"
 )
 
 type RemoteClientBundle struct {
@@ -30,11 +34,22 @@ type RemoteClientBundle struct {
 	Name  string
 
 	dnsResolvers []resolver.Resolver
+	validator    *dnssec.Validator
+	// unvalidated is set if validation is skipped for the CD bit, such responses are not cached
+	unvalidated bool
 }
 
-func NewClientBundle(q *dns.Msg, ul []*common.DNSUpstream, resolvers []resolver.Resolver, ip string, minimumTTL int, cache *cache.Cache, name string, domainTTLMap map[string]uint32) *RemoteClientBundle {
+func NewClientBundle(q *dns.Msg, ul []*common.DNSUpstream, resolvers []resolver.Resolver, ip string, minimumTTL int, cache *cache.Cache, name string, domainTTLMap map[string]uint32, validator *dnssec.Validator) *RemoteClientBundle {
 	cb := &RemoteClientBundle{questionMessage: q.Copy(), dnsUpstreams: ul, dnsResolvers: resolvers, inboundIP: ip, minimumTTL: minimumTTL, cache: cache, Name: name, domainTTLMap: domainTTLMap}
 
+	// Validation is skipped if the client asked for it with the CD bit
+	if validator != nil && cb.questionMessage.CheckingDisabled {
+		cb.unvalidated = true
+	} else if validator != nil {
+		cb.validator = validator
+		dnssec.SetDO(cb.questionMessage)
+	}
+
 	for i, u := range ul {
 		c := NewClient(cb.questionMessage, u, cb.dnsResolvers[i], cb.inboundIP, cb.cache)
 		cb.clients = append(cb.clients, c)
@@ -43,24 +58,40 @@ func NewClientBundle(q *dns.Msg, ul []*common.DNSUpstream, resolvers []resolver.
 	return cb
 }
 
-func (cb *RemoteClientBundle) Exchange(isCache bool, isLog bool) *dns.Msg {
+// Exchange queries all upstreams of the bundle concurrently and returns the first response with
+// answers. Upstreams which are still in progress are cancelled when it returns or ctx is done.
+func (cb *RemoteClientBundle) Exchange(ctx context.Context, isCache bool, isLog bool) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	ch := make(chan *RemoteClient, len(cb.clients))
 
 	for _, o := range cb.clients {
 		go func(c *RemoteClient, ch chan *RemoteClient) {
-			c.Exchange(isLog)
+			c.Exchange(ctx, isLog)
+			// Bogus responses become SERVFAIL without answer, so that the other upstreams are waited for
+			if cb.validator != nil && c.responseMessage != nil {
+				c.responseMessage = cb.validator.Validate(ctx, c.questionMessage, c.responseMessage)
+			}
 			ch <- c
 		}(o, ch)
 	}
 
 	var ec *RemoteClient
 
+Loop:
 	for i := 0; i < len(cb.clients); i++ {
-		c := <-ch
+		var c *RemoteClient
+		select {
+		case c = <-ch:
+		case <-ctx.Done():
+			log.Debugf("%s DNS exchange cancelled: %s", cb.Name, ctx.Err())
+			break Loop
+		}
 		if c != nil {
 			ec = c
 			if ec.responseMessage != nil && ec.responseMessage.Answer != nil {
-				break
+				break Loop
 			}
 			log.Debugf("DNSUpstream has %s returned None answer which will be discarded and wait for the next one", ec.dnsUpstream.Address)
 		}
@@ -91,10 +122,61 @@ func (cb *RemoteClientBundle) ExchangeFromCache() *dns.Msg {
 	return cb.responseMessage
 }
 
+// PeekCache returns the cached response of this bundle like ExchangeFromCache, but the lookup is
+// neither counted nor does it change what the cache evicts or prefetches.
+func (cb *RemoteClientBundle) PeekCache() *dns.Msg {
+	for _, o := range cb.clients {
+		if m := o.PeekCache(); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// ExchangeFromStaleCache answers from expired cache entries of this bundle, see cache.Cache.Stale. The
+// response of this bundle is left alone, as an exchange may still be setting it after the query deadline.
+func (cb *RemoteClientBundle) ExchangeFromStaleCache() *dns.Msg {
+	for _, o := range cb.clients {
+		if m := o.ExchangeFromStaleCache(); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// HasStaleCache reports whether ExchangeFromStaleCache would answer.
+func (cb *RemoteClientBundle) HasStaleCache() bool {
+	return cb.ExchangeFromStaleCache() != nil
+}
+
+// PrefetchSource reports whether the cached response of this bundle should be refreshed
+// in the background, and the name of the bundle which produced it.
+func (cb *RemoteClientBundle) PrefetchSource() (string, bool) {
+	if cb.cache == nil {
+		return "", false
+	}
+	for _, c := range cb.clients {
+		if source, ok := cb.cache.Prefetch(cb.cache.MatchKey(cb.questionMessage.Question[0], c.ednsClientSubnet)); ok {
+			return source, true
+		}
+	}
+	return "", false
+}
+
 func (cb *RemoteClientBundle) CacheResultIfNeeded() {
-	if cb.cache != nil {
-		cb.cache.InsertMessage(cache.Key(cb.questionMessage.Question[0], common.GetEDNSClientSubnetIP(cb.questionMessage)), cb.responseMessage, uint32(cb.minimumTTL))
+	if cb.cache != nil && !cb.unvalidated {
+		key := cb.cache.ScopedKey(cb.questionMessage.Question[0], common.GetEDNSClientSubnet(cb.questionMessage), cb.responseMessage)
+		cb.cache.InsertMessage(key, cb.responseMessage, uint32(cb.minimumTTL), cb.Name)
+	}
+}
+
+// EDNSClientSubnets returns the ECS subnets which the clients of this bundle send upstream, joined by commas.
+func (cb *RemoteClientBundle) EDNSClientSubnets() string {
+	subnets := make([]string, len(cb.clients))
+	for i, c := range cb.clients {
+		subnets[i] = c.ednsClientSubnet
 	}
+	return strings.Join(subnets, ",")
 }
 
 func (cb *RemoteClientBundle) IsType(t uint16) bool {
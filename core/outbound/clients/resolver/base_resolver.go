@@ -6,6 +6,8 @@
 package resolver
 
 import (
+	"context"
+
 	"github.com/miekg/dns"
 	"github.com/silenceper/pool"
 	log "github.com/sirupsen/logrus"
@@ -17,7 +19,8 @@ import (
 )
 
 type Resolver interface {
-	Exchange(*dns.Msg) (*dns.Msg, error)
+	// Exchange sends the question to the upstream, it returns early with an error once ctx is done
+	Exchange(context.Context, *dns.Msg) (*dns.Msg, error)
 	Init() error
 }
 
@@ -25,22 +28,23 @@ type BaseResolver struct {
 	dnsUpstream *common.DNSUpstream
 }
 
-func (r *BaseResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
-	conn, err := r.CreateBaseConn()
+func (r *BaseResolver) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	conn, err := r.CreateBaseConn(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	return r.exchangeByConnWithoutClose(q, conn)
+	return r.exchangeByConnWithoutClose(ctx, q, conn)
 }
 
-func (r *BaseResolver) exchangeByConnWithoutClose(q *dns.Msg, conn net.Conn) (msg *dns.Msg, err error) {
+func (r *BaseResolver) exchangeByConnWithoutClose(ctx context.Context, q *dns.Msg, conn net.Conn) (msg *dns.Msg, err error) {
 	if conn == nil {
 		log.Fatal("Conn not initialized for exchangeByDNSClient")
 		return nil, err
 	}
 
-	r.setTimeout(conn)
+	r.setTimeout(ctx, conn)
+	defer watchContext(ctx, conn)()
 	dc := &dns.Conn{Conn: conn, UDPSize: 65535}
 	err = dc.WriteMsg(q)
 	if err != nil {
@@ -76,6 +80,8 @@ func NewResolver(u *common.DNSUpstream) Resolver {
 		resolver = &TCPTLSResolver{BaseResolver: BaseResolver{u}}
 	case "https":
 		resolver = &HTTPSResolver{BaseResolver: BaseResolver{u}}
+	case "recursive":
+		resolver = &RecursiveResolver{BaseResolver: BaseResolver{u}}
 	default:
 		log.Fatalf("Unsupported protocol: %s", u.Protocol)
 		log.Errorf("Create resolver for %s failed", u.Name)
@@ -90,9 +96,9 @@ func NewResolver(u *common.DNSUpstream) Resolver {
 	return resolver
 }
 
-func (r *BaseResolver) CreateBaseConn() (net.Conn, error) {
+func (r *BaseResolver) CreateBaseConn(ctx context.Context) (net.Conn, error) {
 	dialer := net.Dialer{Timeout: r.getDialTimeout()}
-	dialerFunc := dialer.Dial
+	dialerFunc := dialer.DialContext
 	if r.dnsUpstream.SOCKS5Address != "" {
 		socksAddress, err := ExtractFullUrl(r.dnsUpstream.SOCKS5Address, "socks5")
 		if err != nil {
@@ -104,7 +110,13 @@ func (r *BaseResolver) CreateBaseConn() (net.Conn, error) {
 			log.Warnf("Failed to connect to SOCKS5 proxy: %s", err)
 			return nil, err
 		}
-		dialerFunc = s.Dial
+		if cd, ok := s.(proxy.ContextDialer); ok {
+			dialerFunc = cd.DialContext
+		} else {
+			dialerFunc = func(_ context.Context, network, address string) (net.Conn, error) {
+				return s.Dial(network, address)
+			}
+		}
 	}
 
 	network := ToNetwork(r.dnsUpstream.Protocol)
@@ -115,7 +127,7 @@ func (r *BaseResolver) CreateBaseConn() (net.Conn, error) {
 	address := net.JoinHostPort(host, port)
 	log.Debugf("Creating new connection to %s:%s", host, port)
 	var conn net.Conn
-	if conn, err = dialerFunc(network, address); err != nil {
+	if conn, err = dialerFunc(ctx, network, address); err != nil {
 		log.Warnf("Failed to connect to DNS upstream: %s", err)
 		return nil, err
 	}
@@ -129,11 +141,31 @@ var InitialCapacity = 0
 var IdleTimeout = 30 * time.Second
 var MaxCapacity = 15
 
-func (r *BaseResolver) setTimeout(conn net.Conn) {
+func (r *BaseResolver) setTimeout(ctx context.Context, conn net.Conn) {
 	dnsTimeout := time.Duration(r.dnsUpstream.Timeout) * time.Second / 3
-	conn.SetDeadline(time.Now().Add(dnsTimeout))
-	conn.SetReadDeadline(time.Now().Add(dnsTimeout))
-	conn.SetWriteDeadline(time.Now().Add(dnsTimeout))
+	deadline := time.Now().Add(dnsTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+}
+
+// watchContext interrupts the I/O on conn once ctx is done, the returned function stops watching.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
 
 func (r *BaseResolver) getDialTimeout() time.Duration {
@@ -158,13 +190,13 @@ func (r *BaseResolver) createConnectionPool(connCreate func() (interface{}, erro
 	return pool.NewChannelPool(poolConfig)
 }
 
-func (r *BaseResolver) exchangeByPool(q *dns.Msg, poolConn pool.Pool) (msg *dns.Msg, err error) {
+func (r *BaseResolver) exchangeByPool(ctx context.Context, q *dns.Msg, poolConn pool.Pool) (msg *dns.Msg, err error) {
 	_conn, err := poolConn.Get()
 	if err != nil {
 		return nil, err
 	}
 	conn := _conn.(net.Conn)
-	ret, err := r.exchangeByConnWithoutClose(q, conn)
+	ret, err := r.exchangeByConnWithoutClose(ctx, q, conn)
 	if err != nil {
 		poolConn.Close(conn)
 	} else {
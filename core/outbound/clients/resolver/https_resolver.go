@@ -2,6 +2,7 @@ package resolver
 
 import (
 	"bytes"
+	"context"
 	"github.com/miekg/dns"
 	"io/ioutil"
 	"net"
@@ -13,10 +14,17 @@ type HTTPSResolver struct {
 	client http.Client
 }
 
-func (r *HTTPSResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+func (r *HTTPSResolver) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	request, err := q.Pack()
-	resp, err := r.client.Post(r.dnsUpstream.Address, "application/dns-message",
-		bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.dnsUpstream.Address, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	resp, err := r.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -40,8 +48,8 @@ func (r *HTTPSResolver) Init() error {
 	}
 	r.client = http.Client{
 		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return r.CreateBaseConn()
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return r.CreateBaseConn(ctx)
 			},
 		},
 	}
@@ -0,0 +1,359 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// IPv4 addresses of the root servers, see https://www.iana.org/domains/root/servers
+var rootHints = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+const (
+	maxReferrals   = 16
+	maxCNAMEs      = 8
+	maxDepth       = 6
+	maxDelegations = 10000
+	// maxResolutionReferrals bounds the referrals followed for one question, including the ones of
+	// CNAME targets and name server addresses resolved on the way
+	maxResolutionReferrals = 64
+)
+
+// RecursiveResolver resolves questions iteratively from the root servers instead of forwarding them.
+// The address of the upstream, if set, replaces the root hints by comma separated addresses, and name
+// servers of delegated zones are queried on the same port as them.
+type RecursiveResolver struct {
+	BaseResolver
+
+	roots []string
+	port  string
+
+	delegations     map[string]*delegation
+	delegationsLock sync.RWMutex
+}
+
+// resolution is the state shared by the queries made to resolve one question. The DO bit and the
+// ECS option of the question are sent along with every query.
+type resolution struct {
+	dnssecOK  bool
+	subnet    *dns.EDNS0_SUBNET
+	referrals int
+}
+
+func newResolution(q *dns.Msg) *resolution {
+	res := new(resolution)
+	if o := q.IsEdns0(); o != nil {
+		res.dnssecOK = o.Do()
+		for _, option := range o.Option {
+			if e, ok := option.(*dns.EDNS0_SUBNET); ok {
+				res.subnet = e
+			}
+		}
+	}
+	return res
+}
+
+// delegation is a cached zone cut with the addresses of its name servers
+type delegation struct {
+	servers []string
+	expire  time.Time
+}
+
+func (r *RecursiveResolver) Init() error {
+	r.delegations = make(map[string]*delegation)
+	r.port = "53"
+	if r.dnsUpstream.Address == "" {
+		r.roots = rootHints
+		return nil
+	}
+	for _, a := range strings.Split(r.dnsUpstream.Address, ",") {
+		host, port, err := ExtractDNSAddress(strings.TrimSpace(a), "udp")
+		if err != nil {
+			return err
+		}
+		r.roots = append(r.roots, host)
+		r.port = port
+	}
+	return nil
+}
+
+func (r *RecursiveResolver) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) == 0 {
+		return nil, errors.New("no question")
+	}
+	resp, err := r.resolve(ctx, newResolution(q), q.Question[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Question = q.Question
+	resp.Id = q.Id
+	resp.Response = true
+	resp.RecursionDesired = q.RecursionDesired
+	resp.RecursionAvailable = true
+	resp.Authoritative = false
+	return resp, nil
+}
+
+// resolve follows referrals from the closest known delegation of the question, depth counts the
+// nested resolutions of CNAME targets and name server addresses.
+func (r *RecursiveResolver) resolve(ctx context.Context, res *resolution, question dns.Question, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("resolving %s is too deep", question.Name)
+	}
+	zone, servers := r.closestDelegation(question.Name)
+	for i := 0; i < maxReferrals; i++ {
+		resp, err := r.queryServers(ctx, res, servers, question)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+			return r.chaseCNAME(ctx, res, question, resp, depth)
+		}
+		child, nsNames, ttl := referral(resp, zone, question.Name)
+		if child == "" {
+			return resp, nil
+		}
+		if res.referrals++; res.referrals > maxResolutionReferrals {
+			return nil, fmt.Errorf("too many referrals resolving %s", question.Name)
+		}
+		log.Debugf("%s is delegated to %s by %s", question.Name, strings.Join(nsNames, ","), child)
+		servers = r.delegationServers(ctx, res, zone, nsNames, resp, depth)
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no reachable name server of %s", child)
+		}
+		r.storeDelegation(child, servers, ttl)
+		zone = child
+	}
+	return nil, fmt.Errorf("too many referrals for %s", question.Name)
+}
+
+// chaseCNAME resolves the target of the CNAME chain in resp if the chain does not end in an answer
+func (r *RecursiveResolver) chaseCNAME(ctx context.Context, res *resolution, question dns.Question, resp *dns.Msg, depth int) (*dns.Msg, error) {
+	if resp.Rcode != dns.RcodeSuccess || question.Qtype == dns.TypeCNAME {
+		return resp, nil
+	}
+	target := question.Name
+	for i := 0; i < maxCNAMEs; i++ {
+		next := cnameTarget(resp.Answer, target)
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if strings.EqualFold(target, question.Name) || hasRR(resp.Answer, target, question.Qtype) {
+		return resp, nil
+	}
+	sub, err := r.resolve(ctx, res, dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	sub.Answer = append(append([]dns.RR{}, resp.Answer...), sub.Answer...)
+	return sub, nil
+}
+
+func cnameTarget(rrs []dns.RR, name string) string {
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+			return c.Target
+		}
+	}
+	return ""
+}
+
+func hasRR(rrs []dns.RR, name string, t uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// referral returns the child zone, its name servers and the TTL of the delegation if resp
+// delegates name to a zone below zone.
+func referral(resp *dns.Msg, zone string, name string) (child string, nsNames []string, ttl uint32) {
+	name = dns.CanonicalName(name)
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		if child == "" || ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+		child = owner
+		nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+	}
+	return child, nsNames, ttl
+}
+
+// delegationServers returns the addresses of nsNames from the in-bailiwick glue of resp,
+// or resolves them if there is no usable glue.
+func (r *RecursiveResolver) delegationServers(ctx context.Context, res *resolution, zone string, nsNames []string, resp *dns.Msg, depth int) []string {
+	var servers []string
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, rr := range resp.Extra {
+			name := dns.CanonicalName(rr.Header().Name)
+			if rr.Header().Rrtype != t || !dns.IsSubDomain(zone, name) || !containsName(nsNames, name) {
+				continue
+			}
+			switch a := rr.(type) {
+			case *dns.A:
+				servers = append(servers, a.A.String())
+			case *dns.AAAA:
+				servers = append(servers, a.AAAA.String())
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers
+	}
+
+	for _, ns := range nsNames {
+		m, err := r.resolve(ctx, res, dns.Question{Name: ns, Qtype: dns.TypeA, Qclass: dns.ClassINET}, depth+1)
+		if err != nil {
+			log.Debugf("Resolve name server %s failed: %s", ns, err)
+			continue
+		}
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, a.A.String())
+			}
+		}
+		if len(servers) > 0 {
+			break
+		}
+	}
+	return servers
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// closestDelegation returns the deepest cached zone cut above name and its name servers
+func (r *RecursiveResolver) closestDelegation(name string) (string, []string) {
+	name = dns.CanonicalName(name)
+	now := time.Now()
+
+	r.delegationsLock.RLock()
+	defer r.delegationsLock.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, ok := r.delegations[name[off:]]; ok && now.Before(d.expire) {
+			return name[off:], d.servers
+		}
+	}
+	return ".", r.roots
+}
+
+// storeDelegation caches the name servers of zone, a full cache removes its expired delegations and then
+// random ones until a tenth of it is free
+func (r *RecursiveResolver) storeDelegation(zone string, servers []string, ttl uint32) {
+	now := time.Now()
+
+	r.delegationsLock.Lock()
+	defer r.delegationsLock.Unlock()
+	if _, ok := r.delegations[zone]; !ok && len(r.delegations) >= maxDelegations {
+		for z, d := range r.delegations {
+			if !now.Before(d.expire) {
+				delete(r.delegations, z)
+			}
+		}
+		for z := range r.delegations {
+			if len(r.delegations) < maxDelegations-maxDelegations/10 {
+				break
+			}
+			delete(r.delegations, z)
+		}
+	}
+	r.delegations[zone] = &delegation{servers: servers, expire: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// queryServers asks the name servers one by one until one of them answers
+func (r *RecursiveResolver) queryServers(ctx context.Context, res *resolution, servers []string, question dns.Question) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(question.Name, question.Qtype)
+	m.Question[0].Qclass = question.Qclass
+	m.RecursionDesired = false
+	m.SetEdns0(4096, res.dnssecOK)
+	if res.subnet != nil {
+		o := m.IsEdns0()
+		o.Option = append(o.Option, res.subnet)
+	}
+
+	var lastResp *dns.Msg
+	var err error
+	for _, s := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var resp *dns.Msg
+		resp, err = r.queryServer(ctx, net.JoinHostPort(s, r.port), m)
+		if err != nil {
+			log.Debugf("Query %s for %s failed: %s", s, question.Name, err)
+			continue
+		}
+		// Try the next name server if this one is lame
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			lastResp = resp
+			continue
+		}
+		return resp, nil
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	if err == nil {
+		err = errors.New("no name server")
+	}
+	return nil, err
+}
+
+func (r *RecursiveResolver) queryServer(ctx context.Context, address string, m *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", Timeout: r.getDialTimeout()}
+	resp, _, err := c.ExchangeContext(ctx, m, address)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, m, address)
+	}
+	return resp, err
+}
@@ -0,0 +1,178 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+func newRR(s string) dns.RR {
+	rr, _ := dns.NewRR(s)
+	return rr
+}
+
+// authoritativeServer answers from records, or refers to the delegations, or NXDOMAIN otherwise
+func authoritativeServer(records map[string][]dns.RR, delegations map[string][]dns.RR, glue []dns.RR, queries *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, q *dns.Msg) {
+		if queries != nil {
+			atomic.AddInt32(queries, 1)
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		name := dns.CanonicalName(q.Question[0].Name)
+		if rrs, ok := records[name]; ok {
+			m.Authoritative = true
+			m.Answer = rrs
+		} else {
+			m.Rcode = dns.RcodeNameError
+			for zone, ns := range delegations {
+				if dns.IsSubDomain(zone, name) {
+					m.Rcode = dns.RcodeSuccess
+					m.Ns = ns
+					m.Extra = glue
+				}
+			}
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	root, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(root.LocalAddr().String())
+	example, err := net.ListenPacket("udp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Skip("127.0.0.2 is not available:", err)
+	}
+	other, err := net.ListenPacket("udp", "127.0.0.3:"+port)
+	if err != nil {
+		t.Skip("127.0.0.3 is not available:", err)
+	}
+
+	var rootQueries int32
+	servers := []*dns.Server{
+		{PacketConn: root, Handler: authoritativeServer(nil, map[string][]dns.RR{
+			"example.": {newRR("example. 3600 IN NS ns.example.")},
+			"other.":   {newRR("other. 3600 IN NS ns2.example.")},
+		}, []dns.RR{newRR("ns.example. 3600 IN A 127.0.0.2")}, &rootQueries)},
+		{PacketConn: example, Handler: authoritativeServer(map[string][]dns.RR{
+			"www.example.":   {newRR("www.example. 300 IN A 10.0.0.1")},
+			"ns2.example.":   {newRR("ns2.example. 300 IN A 127.0.0.3")},
+			"alias.example.": {newRR("alias.example. 300 IN CNAME www.other.")},
+		}, nil, nil, nil)},
+		{PacketConn: other, Handler: authoritativeServer(map[string][]dns.RR{
+			"www.other.": {newRR("www.other. 300 IN A 10.0.0.2")},
+		}, nil, nil, nil)},
+	}
+	for _, s := range servers {
+		go s.ActivateAndServe()
+		defer s.Shutdown()
+	}
+
+	r := NewResolver(&common.DNSUpstream{
+		Name:             "Test-Recursive",
+		Address:          "127.0.0.1:" + port,
+		Protocol:         "recursive",
+		Timeout:          6,
+		EDNSClientSubnet: &common.EDNSClientSubnetType{Policy: "disable"},
+	})
+
+	exchange := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		resp, err := r.Exchange(context.Background(), q)
+		if err != nil {
+			t.Fatalf("resolve %s failed: %s", name, err)
+		}
+		if resp.Id != q.Id || !resp.RecursionAvailable {
+			t.Errorf("unexpected header of %s: %s", name, resp)
+		}
+		return resp
+	}
+
+	resp := exchange("www.example.")
+	if len(resp.Answer) != 1 || !strings.Contains(resp.Answer[0].String(), "10.0.0.1") {
+		t.Errorf("unexpected answer: %s", resp)
+	}
+
+	// The CNAME target is delegated without glue
+	resp = exchange("alias.example.")
+	if len(resp.Answer) != 2 || !strings.Contains(resp.Answer[1].String(), "10.0.0.2") {
+		t.Errorf("unexpected answer: %s", resp)
+	}
+
+	resp = exchange("none.example.")
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %s", resp)
+	}
+
+	// Both delegations are cached now
+	n := atomic.LoadInt32(&rootQueries)
+	exchange("www.other.")
+	exchange("www.example.")
+	if atomic.LoadInt32(&rootQueries) != n {
+		t.Errorf("root servers queried again for cached delegations")
+	}
+}
+
+func TestRecursiveResolver_EDNS(t *testing.T) {
+	root, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := make(chan *dns.Msg, 1)
+	answer := authoritativeServer(map[string][]dns.RR{
+		"www.example.": {newRR("www.example. 300 IN A 10.0.0.1")},
+	}, nil, nil, nil)
+	s := &dns.Server{PacketConn: root, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		queries <- q
+		answer(w, q)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	r := NewResolver(&common.DNSUpstream{
+		Name:             "Test-Recursive",
+		Address:          root.LocalAddr().String(),
+		Protocol:         "recursive",
+		Timeout:          6,
+		EDNSClientSubnet: &common.EDNSClientSubnetType{Policy: "disable"},
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.", dns.TypeA)
+	q.SetEdns0(1232, true)
+	common.SetEDNSClientSubnet(q, common.NewEDNSClientSubnet(net.ParseIP("192.0.2.1"), 24))
+	if _, err := r.Exchange(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := <-queries
+	o := sent.IsEdns0()
+	if o == nil || !o.Do() {
+		t.Fatalf("DO bit of the query should be sent, got %s", sent)
+	}
+	if subnet := common.GetEDNSClientSubnet(sent); subnet != "192.0.2.0/24" {
+		t.Errorf("ECS of the query should be sent, got %q", subnet)
+	}
+}
+
+func TestRecursiveResolver_Delegations(t *testing.T) {
+	r := &RecursiveResolver{delegations: make(map[string]*delegation)}
+	for i := 0; i < 2*maxDelegations; i++ {
+		r.storeDelegation(strconv.Itoa(i)+".example.", []string{"192.0.2.1:53"}, 3600)
+	}
+	if len(r.delegations) > maxDelegations {
+		t.Errorf("%d delegations should be cached at most, got %d", maxDelegations, len(r.delegations))
+	}
+}
@@ -1,6 +1,8 @@
 package resolver
 
 import (
+	"context"
+
 	"github.com/miekg/dns"
 	"github.com/shawn1m/overture/core/common"
 	"net"
@@ -75,7 +77,7 @@ func TestDispatcher(t *testing.T) {
 func testUDP(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
 	resolver := NewResolver(udpUpstream)
-	resp, err := resolver.Exchange(q)
+	resp, err := resolver.Exchange(context.Background(), q)
 	if err != nil {
 		t.Errorf("Got error: %s", err)
 	}
@@ -87,7 +89,7 @@ func testUDP(t *testing.T) {
 func testTCP(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
 	resolver := NewResolver(tcpUpstream)
-	resp, _ := resolver.Exchange(q)
+	resp, _ := resolver.Exchange(context.Background(), q)
 	if net.ParseIP(common.FindRecordByType(resp, dns.TypeA)).To4() == nil {
 		t.Error(questionDomain + " should have A record")
 	}
@@ -96,7 +98,7 @@ func testTCP(t *testing.T) {
 func testTCPTLS(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
 	resolver := NewResolver(tcpTlsUpstream)
-	resp, _ := resolver.Exchange(q)
+	resp, _ := resolver.Exchange(context.Background(), q)
 	if net.ParseIP(common.FindRecordByType(resp, dns.TypeA)).To4() == nil {
 		t.Error(questionDomain + " should have A record")
 	}
@@ -105,7 +107,7 @@ func testTCPTLS(t *testing.T) {
 func testHTTPS(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
 	resolver := NewResolver(httpsUpstream)
-	resp, _ := resolver.Exchange(q)
+	resp, _ := resolver.Exchange(context.Background(), q)
 	if net.ParseIP(common.FindRecordByType(resp, dns.TypeA)).To4() == nil {
 		t.Error(questionDomain + " should have A record")
 	}
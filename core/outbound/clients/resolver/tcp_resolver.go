@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"context"
 	"net"
 
 	"github.com/miekg/dns"
@@ -13,11 +14,11 @@ type TCPResolver struct {
 	poolConn pool.Pool
 }
 
-func (r *TCPResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+func (r *TCPResolver) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	if r.dnsUpstream.TCPPoolConfig.Enable {
-		return r.BaseResolver.exchangeByPool(q, r.poolConn)
+		return r.BaseResolver.exchangeByPool(ctx, q, r.poolConn)
 	} else {
-		return r.BaseResolver.Exchange(q)
+		return r.BaseResolver.Exchange(ctx, q)
 	}
 }
 
@@ -28,7 +29,7 @@ func (r *TCPResolver) Init() error {
 	}
 	if r.dnsUpstream.TCPPoolConfig.Enable {
 		r.poolConn, err = r.createConnectionPool(
-			func() (interface{}, error) { return r.CreateBaseConn() },
+			func() (interface{}, error) { return r.CreateBaseConn(context.Background()) },
 			func(v interface{}) error { return v.(net.Conn).Close() })
 		if err != nil {
 			log.Debugf("Set %s pool's IdleTimeout to %d, InitialCapacity to %d, MaxCapacity to %d", r.dnsUpstream.Name, r.dnsUpstream.TCPPoolConfig.IdleTimeout, r.dnsUpstream.TCPPoolConfig.InitialCapacity, r.dnsUpstream.TCPPoolConfig.MaxCapacity)
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 
@@ -14,22 +15,22 @@ type TCPTLSResolver struct {
 	poolConn pool.Pool
 }
 
-func (r *TCPTLSResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+func (r *TCPTLSResolver) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	if r.dnsUpstream.TCPPoolConfig.Enable {
-		return r.BaseResolver.exchangeByPool(q, r.poolConn)
+		return r.BaseResolver.exchangeByPool(ctx, q, r.poolConn)
 	} else {
-		conn, err := r.createTlsConn()
+		conn, err := r.createTlsConn(ctx)
 		if err != nil {
 			log.Warnf("createTlsConn failed: %s", err)
 			return nil, err
 		}
 		defer conn.Close()
-		return r.exchangeByConnWithoutClose(q, conn)
+		return r.exchangeByConnWithoutClose(ctx, q, conn)
 	}
 }
 
-func (r *TCPTLSResolver) createTlsConn() (conn net.Conn, err error) {
-	conn, err = r.CreateBaseConn()
+func (r *TCPTLSResolver) createTlsConn(ctx context.Context) (conn net.Conn, err error) {
+	conn, err = r.CreateBaseConn(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +54,7 @@ func (r *TCPTLSResolver) Init() error {
 	}
 	if r.dnsUpstream.TCPPoolConfig.Enable {
 		r.poolConn, err = r.createConnectionPool(
-			func() (interface{}, error) { return r.createTlsConn() },
+			func() (interface{}, error) { return r.createTlsConn(context.Background()) },
 			func(v interface{}) error { return v.(net.Conn).Close() })
 		if err != nil {
 			log.Debugf("Set %s pool's IdleTimeout to %d, InitialCapacity to %d, MaxCapacity to %d", r.dnsUpstream.Name, r.dnsUpstream.TCPPoolConfig.IdleTimeout, r.dnsUpstream.TCPPoolConfig.InitialCapacity, r.dnsUpstream.TCPPoolConfig.MaxCapacity)
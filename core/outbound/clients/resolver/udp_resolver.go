@@ -1,6 +1,8 @@
 package resolver
 
 import (
+	"context"
+
 	"github.com/miekg/dns"
 )
 
@@ -8,8 +10,8 @@ type UDPResolver struct {
 	BaseResolver
 }
 
-func (r *UDPResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
-	return r.BaseResolver.Exchange(q)
+func (r *UDPResolver) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return r.BaseResolver.Exchange(ctx, q)
 }
 
 func (r *UDPResolver) Init() error {
@@ -1,7 +1,10 @@
 package outbound
 
 import (
+	"context"
+	"errors"
 	"net"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/shawn1m/overture/core/outbound/clients/resolver"
@@ -9,9 +12,15 @@ import (
 
 	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/dnssec"
+	"github.com/shawn1m/overture/core/finder/suffix"
 	"github.com/shawn1m/overture/core/hosts"
+	"github.com/shawn1m/overture/core/leases"
 	"github.com/shawn1m/overture/core/matcher"
 	"github.com/shawn1m/overture/core/outbound/clients"
+	"github.com/shawn1m/overture/core/policy"
+	"github.com/shawn1m/overture/core/records"
+	"github.com/shawn1m/overture/core/zone"
 )
 
 type Dispatcher struct {
@@ -19,22 +28,40 @@ type Dispatcher struct {
 	AlternativeDNS []*common.DNSUpstream
 	OnlyPrimaryDNS bool
 
+	Fallback *common.FallbackPolicy
+	// WhenPrimaryDNSAnswerNoneUse is deprecated by Fallback
 	WhenPrimaryDNSAnswerNoneUse string
 	IPNetworkPrimarySet         *common.IPSet
 	IPNetworkAlternativeSet     *common.IPSet
 	DomainPrimaryList           matcher.Matcher
 	DomainAlternativeList       matcher.Matcher
 	RedirectIPv6Record          bool
+	AAAAPolicy                  policy.AAAAList
+	DNS64                       *policy.DNS64
 	AlternativeDNSConcurrent    bool
+	QueryTimeout                time.Duration
+	PrimaryDNSSEC               bool
+	AlternativeDNSSEC           bool
+	TrustAnchors                []*dns.DS
+	ForwardZones                []*common.ForwardZone
 
-	MinimumTTL   int
-	DomainTTLMap map[string]uint32
+	MinimumTTL           int
+	DomainTTLMap         map[string]uint32
+	LocalSpecialUseNames bool
 
-	Hosts *hosts.Hosts
-	Cache *cache.Cache
+	Zones        *zone.Zones
+	Hosts        *hosts.Hosts
+	Leases       *leases.Leases
+	LocalRecords *records.Records
+	Cache        *cache.Cache
 
 	primaryResolvers     []resolver.Resolver
 	alternativeResolvers []resolver.Resolver
+	primaryValidator     *dnssec.Validator
+	alternativeValidator *dnssec.Validator
+	forwardTree          *suffix.Tree
+	forwardZones         map[string]*forwardZone
+	inflight             *inflightGroup
 }
 
 func createResolver(ul []*common.DNSUpstream) (resolvers []resolver.Resolver) {
@@ -48,42 +75,276 @@ func createResolver(ul []*common.DNSUpstream) (resolvers []resolver.Resolver) {
 func (d *Dispatcher) Init() {
 	d.primaryResolvers = createResolver(d.PrimaryDNS)
 	d.alternativeResolvers = createResolver(d.AlternativeDNS)
+	if d.PrimaryDNSSEC {
+		d.primaryValidator = dnssec.NewValidator(d.TrustAnchors, exchangeByResolvers(d.primaryResolvers))
+	}
+	if d.AlternativeDNSSEC {
+		d.alternativeValidator = dnssec.NewValidator(d.TrustAnchors, exchangeByResolvers(d.alternativeResolvers))
+	}
+	d.initForwardZones()
+	d.inflight = newInflightGroup(d.QueryTimeout)
 }
 
-func (d *Dispatcher) Exchange(query *dns.Msg, inboundIP string) *dns.Msg {
-	PrimaryClientBundle := clients.NewClientBundle(query, d.PrimaryDNS, d.primaryResolvers, inboundIP, d.MinimumTTL, d.Cache, "Primary", d.DomainTTLMap)
-	AlternativeClientBundle := clients.NewClientBundle(query, d.AlternativeDNS, d.alternativeResolvers, inboundIP, d.MinimumTTL, d.Cache, "Alternative", d.DomainTTLMap)
+// exchangeByResolvers returns a function which tries resolvers in order until one of them answers
+func exchangeByResolvers(resolvers []resolver.Resolver) dnssec.ExchangeFunc {
+	return func(ctx context.Context, q *dns.Msg) (m *dns.Msg, err error) {
+		for _, r := range resolvers {
+			if m, err = r.Exchange(ctx, q); err == nil && m != nil {
+				return m, nil
+			}
+		}
+		if err == nil {
+			err = errors.New("no response")
+		}
+		return nil, err
+	}
+}
 
-	var ActiveClientBundle *clients.RemoteClientBundle
+func (d *Dispatcher) newClientBundles(query *dns.Msg, inboundIP string) (*clients.RemoteClientBundle, *clients.RemoteClientBundle) {
+	PrimaryClientBundle := clients.NewClientBundle(query, d.PrimaryDNS, d.primaryResolvers, inboundIP, d.MinimumTTL, d.Cache, "Primary", d.DomainTTLMap, d.primaryValidator)
+	AlternativeClientBundle := clients.NewClientBundle(query, d.AlternativeDNS, d.alternativeResolvers, inboundIP, d.MinimumTTL, d.Cache, "Alternative", d.DomainTTLMap, d.alternativeValidator)
+	return PrimaryClientBundle, AlternativeClientBundle
+}
+
+// inflightKey identifies identical questions with the same ECS subnets, which share one upstream exchange
+func inflightKey(query *dns.Msg, PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) string {
+	key := cache.Key(query.Question[0], PrimaryClientBundle.EDNSClientSubnets()+"/"+AlternativeClientBundle.EDNSClientSubnets())
+	// Responses to queries with the CD bit may not be validated, they are not shared with other queries
+	if query.CheckingDisabled {
+		key += " cd"
+	}
+	return key
+}
+
+// Exchange answers query from inboundIP, upstream exchanges are cancelled once ctx is done.
+// With QueryTimeout set, the whole exchange is bounded by it.
+func (d *Dispatcher) Exchange(ctx context.Context, query *dns.Msg, inboundIP string) *dns.Msg {
+	if d.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.QueryTimeout)
+		defer cancel()
+	}
+
+	action := d.aaaaAction(query, inboundIP)
+	if resp := d.exchangeByAAAAPolicy(ctx, query, inboundIP, action); resp != nil {
+		return resp
+	}
+
+	if resp := d.exchangeDNS64PTR(ctx, query, inboundIP); resp != nil {
+		dnssec.FilterForClient(query, resp)
+		return resp
+	}
+
+	resp := d.exchangeDNS64AAAA(ctx, query, inboundIP, d.exchange(ctx, query, inboundIP))
+	if action == policy.AAAANoData || action == policy.AAAAStripHint {
+		policy.StripIPv6Hint(resp)
+	}
+	// The cache keeps DNSSEC records for clients which ask for them
+	dnssec.FilterForClient(query, resp)
+	return resp
+}
+
+// newLocalClient returns the local client of query, special-use names in forward zones are left to their upstreams
+func (d *Dispatcher) newLocalClient(query *dns.Msg) *clients.LocalClient {
+	specialUseNames := d.LocalSpecialUseNames && d.findForwardZone(query.Question[0].Name) == nil
+	return clients.NewLocalClient(query, d.Hosts, d.Leases, d.LocalRecords, d.MinimumTTL, d.DomainTTLMap, specialUseNames)
+}
 
-	localClient := clients.NewLocalClient(query, d.Hosts, d.MinimumTTL, d.DomainTTLMap)
+func (d *Dispatcher) exchange(ctx context.Context, query *dns.Msg, inboundIP string) *dns.Msg {
+	PrimaryClientBundle, AlternativeClientBundle := d.newClientBundles(query, inboundIP)
+
+	if resp := d.exchangeZone(ctx, query, inboundIP); resp != nil {
+		return resp
+	}
+
+	localClient := d.newLocalClient(query)
 	resp := localClient.Exchange()
 	if resp != nil {
 		return resp
 	}
 
+	if ForwardClientBundle := d.newForwardBundle(query, inboundIP); ForwardClientBundle != nil {
+		return d.exchangeForward(ctx, query, inboundIP, ForwardClientBundle)
+	}
+
 	for _, cb := range []*clients.RemoteClientBundle{PrimaryClientBundle, AlternativeClientBundle} {
 		resp := cb.ExchangeFromCache()
 		if resp != nil {
+			d.Cache.Count(true)
+			if source, ok := cb.PrefetchSource(); ok {
+				d.prefetch(query, inboundIP, source)
+			}
 			return resp
 		}
 	}
+	d.Cache.Count(false)
+
+	// Popular names are answered from stale cache while they are being refreshed
+	for _, cb := range []*clients.RemoteClientBundle{PrimaryClientBundle, AlternativeClientBundle} {
+		if stale := cb.ExchangeFromStaleCache(); stale != nil {
+			if source, ok := cb.PrefetchSource(); ok {
+				d.prefetch(query, inboundIP, source)
+				return stale
+			}
+		}
+	}
+
+	key := inflightKey(query, PrimaryClientBundle, AlternativeClientBundle)
+	resp, shared, err := d.inflight.do(ctx, key, query.Id, func(ctx context.Context) *dns.Msg {
+		return d.exchangeRemote(ctx, query, PrimaryClientBundle, AlternativeClientBundle)
+	})
+	if shared {
+		log.Debugf("Shared in-flight response: %s", key)
+	}
+	if resp == nil && err == context.DeadlineExceeded {
+		return d.exchangeOnDeadline(query, PrimaryClientBundle, AlternativeClientBundle)
+	}
+	return resp
+}
+
+// zoneDepthKey is the context key of the number of CNAME chains leaving local zones being followed
+type zoneDepthKey struct{}
+
+const maxZoneCNAMEs = 8
+
+// exchangeZone answers query from the local zones. CNAME chains leaving a zone are followed through the
+// dispatcher, as stub resolvers expect the server to resolve them.
+func (d *Dispatcher) exchangeZone(ctx context.Context, query *dns.Msg, inboundIP string) *dns.Msg {
+	resp := d.Zones.Exchange(query)
+	target := zoneCNAMETarget(query, resp)
+	depth, _ := ctx.Value(zoneDepthKey{}).(int)
+	if target == "" || depth >= maxZoneCNAMEs {
+		return resp
+	}
+
+	q := query.Copy()
+	q.Question[0].Name = target
+	sub := d.exchange(context.WithValue(ctx, zoneDepthKey{}, depth+1), q, inboundIP)
+	if sub == nil {
+		return resp
+	}
+	resp.Answer = append(resp.Answer, sub.Answer...)
+	if len(sub.Answer) == 0 {
+		resp.Ns = sub.Ns
+	}
+	resp.Rcode = sub.Rcode
+	return resp
+}
+
+// zoneCNAMETarget returns the target of the CNAME chain which resp, the zone answer to query, ends in
+func zoneCNAMETarget(query *dns.Msg, resp *dns.Msg) string {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return ""
+	}
+	if t := query.Question[0].Qtype; t == dns.TypeCNAME || t == dns.TypeANY {
+		return ""
+	}
+	if c, ok := resp.Answer[len(resp.Answer)-1].(*dns.CNAME); ok {
+		return c.Target
+	}
+	return ""
+}
+
+// exchangeOnDeadline answers query from stale cache of bundles, or with SERVFAIL if there is none, after the query deadline passed
+func (d *Dispatcher) exchangeOnDeadline(query *dns.Msg, bundles ...*clients.RemoteClientBundle) *dns.Msg {
+	for _, cb := range bundles {
+		if stale := cb.ExchangeFromStaleCache(); stale != nil {
+			log.Debugf("Query deadline exceeded, answer from %s DNS stale cache", cb.Name)
+			return stale
+		}
+	}
+	log.Debugf("Query deadline exceeded, answer SERVFAIL: %s", query.Question[0].String())
+	resp := new(dns.Msg)
+	resp.SetRcode(query, dns.RcodeServerFailure)
+	if query.IsEdns0() != nil {
+		common.SetExtendedError(resp, dns.ExtendedErrorCodeNoReachableAuthority, "query timeout")
+	}
+	return resp
+}
+
+// prefetch refreshes the cached response of query in the background through the bundle named source
+func (d *Dispatcher) prefetch(query *dns.Msg, inboundIP string, source string) {
+	query = query.Copy()
+	// Refreshed responses are cached, so they are validated whatever the client asked for
+	query.CheckingDisabled = false
+	if ForwardClientBundle := d.newForwardBundle(query, inboundIP); ForwardClientBundle != nil {
+		key := forwardInflightKey(query, ForwardClientBundle)
+		log.Debugf("Prefetch %s from %s DNS", key, ForwardClientBundle.Name)
+		go d.inflight.do(context.Background(), key, query.Id, func(ctx context.Context) *dns.Msg {
+			return ForwardClientBundle.Exchange(ctx, true, false)
+		})
+		return
+	}
+	PrimaryClientBundle, AlternativeClientBundle := d.newClientBundles(query, inboundIP)
+	key := inflightKey(query, PrimaryClientBundle, AlternativeClientBundle)
+	log.Debugf("Prefetch %s from %s DNS", key, source)
+
+	go d.inflight.do(context.Background(), key, query.Id, func(ctx context.Context) *dns.Msg {
+		switch source {
+		case PrimaryClientBundle.Name:
+			return PrimaryClientBundle.Exchange(ctx, true, false)
+		case AlternativeClientBundle.Name:
+			return AlternativeClientBundle.Exchange(ctx, true, false)
+		default:
+			return d.exchangeRemote(ctx, query, PrimaryClientBundle, AlternativeClientBundle)
+		}
+	})
+}
+
+func (d *Dispatcher) exchangeRemote(ctx context.Context, query *dns.Msg, PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) *dns.Msg {
+	var ActiveClientBundle *clients.RemoteClientBundle
+
+	if d.OnlyPrimaryDNS {
+		// Alternative DNS is never queried, not even by the fallback policy
+		ActiveClientBundle = PrimaryClientBundle
+		return d.fallback(ctx, ActiveClientBundle.Exchange(ctx, true, true), ActiveClientBundle, nil, false)
+	}
 
-	if d.OnlyPrimaryDNS || d.isSelectDomain(PrimaryClientBundle, d.DomainPrimaryList) {
+	if d.isSelectDomain(PrimaryClientBundle, d.DomainPrimaryList) {
 		ActiveClientBundle = PrimaryClientBundle
-		return ActiveClientBundle.Exchange(true, true)
+		return d.fallback(ctx, ActiveClientBundle.Exchange(ctx, true, true), ActiveClientBundle, AlternativeClientBundle, false)
 	}
 
 	if ok := d.isExchangeForIPv6(query) || d.isSelectDomain(AlternativeClientBundle, d.DomainAlternativeList); ok {
 		ActiveClientBundle = AlternativeClientBundle
-		return ActiveClientBundle.Exchange(true, true)
+		return d.fallback(ctx, ActiveClientBundle.Exchange(ctx, true, true), ActiveClientBundle, PrimaryClientBundle, false)
 	}
 
-	ActiveClientBundle = d.selectByIPNetwork(PrimaryClientBundle, AlternativeClientBundle)
+	ActiveClientBundle = d.selectByIPNetwork(ctx, PrimaryClientBundle, AlternativeClientBundle)
 
 	// Only try to Cache result before return
 	ActiveClientBundle.CacheResultIfNeeded()
-	return ActiveClientBundle.GetResponseMessage()
+	if ActiveClientBundle == PrimaryClientBundle {
+		return d.fallback(ctx, ActiveClientBundle.GetResponseMessage(), ActiveClientBundle, AlternativeClientBundle, false)
+	}
+	// Primary DNS has already been queried, so the retry is used up
+	return d.fallback(ctx, ActiveClientBundle.GetResponseMessage(), ActiveClientBundle, PrimaryClientBundle, true)
+}
+
+// fallback applies the fallback policy to resp, which has been returned by the active bundle. The other
+// bundle is queried at most once for a query, so it is not retried if retried is set, nor if it is nil.
+func (d *Dispatcher) fallback(ctx context.Context, resp *dns.Msg, active, other *clients.RemoteClientBundle, retried bool) *dns.Msg {
+	switch d.Fallback.Action(resp) {
+	case common.FallbackRetry:
+		if other == nil || retried {
+			break
+		}
+		log.Debugf("%s DNS response needs fallback, finally use %s DNS", active.Name, other.Name)
+		if r := other.Exchange(ctx, true, true); r != nil {
+			return r
+		}
+	case common.FallbackStale:
+		for _, cb := range []*clients.RemoteClientBundle{active, other} {
+			if cb == nil {
+				continue
+			}
+			if stale := cb.ExchangeFromStaleCache(); stale != nil {
+				log.Debugf("%s DNS response needs fallback, finally use stale cache of %s DNS", active.Name, cb.Name)
+				return stale
+			}
+		}
+	}
+	return resp
 }
 
 func (d *Dispatcher) isExchangeForIPv6(query *dns.Msg) bool {
@@ -117,14 +378,40 @@ func (d *Dispatcher) isSelectDomain(rcb *clients.RemoteClientBundle, dt matcher.
 	return false
 }
 
-func (d *Dispatcher) selectByIPNetwork(PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) *clients.RemoteClientBundle {
-	primaryOut := make(chan *dns.Msg)
-	alternateOut := make(chan *dns.Msg)
+// isAnswerNoneUseAlternative reports whether alternative DNS is used for resp, an answerless response of
+// primary DNS, by the fallback policy or the deprecated whenPrimaryDNSAnswerNoneUse.
+func (d *Dispatcher) isAnswerNoneUseAlternative(resp *dns.Msg) bool {
+	if d.WhenPrimaryDNSAnswerNoneUse == "alternativeDNS" || d.WhenPrimaryDNSAnswerNoneUse == "AlternativeDNS" {
+		return true
+	}
+	return d.Fallback.Action(resp) == common.FallbackRetry
+}
+
+// isTimeoutUseAlternative reports whether alternative DNS is used after primary DNS failed or timed
+// out, which the timeout action of the fallback policy decides. Stale answers are preferred to it.
+func (d *Dispatcher) isTimeoutUseAlternative(PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) bool {
+	switch d.Fallback.Action(nil) {
+	case common.FallbackRetry:
+		return true
+	case common.FallbackStale:
+		return !PrimaryClientBundle.HasStaleCache() && !AlternativeClientBundle.HasStaleCache()
+	default:
+		return false
+	}
+}
+
+func (d *Dispatcher) selectByIPNetwork(ctx context.Context, PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) *clients.RemoteClientBundle {
+	// Buffered so that an exchange whose result is never read does not block forever
+	primaryOut := make(chan *dns.Msg, 1)
+	alternateOut := make(chan *dns.Msg, 1)
+	// A concurrent alternative exchange is cancelled if primary DNS is chosen
+	alternateCtx, cancelAlternate := context.WithCancel(ctx)
+	defer cancelAlternate()
 	go func() {
-		primaryOut <- PrimaryClientBundle.Exchange(false, true)
+		primaryOut <- PrimaryClientBundle.Exchange(ctx, false, true)
 	}()
 	alternateFunc := func() {
-		alternateOut <- AlternativeClientBundle.Exchange(false, true)
+		alternateOut <- AlternativeClientBundle.Exchange(alternateCtx, false, true)
 	}
 	waitAlternateResp := func() {
 		if !d.AlternativeDNSConcurrent {
@@ -139,7 +426,7 @@ func (d *Dispatcher) selectByIPNetwork(PrimaryClientBundle, AlternativeClientBun
 
 	if primaryResponse != nil {
 		if primaryResponse.Answer == nil {
-			if d.WhenPrimaryDNSAnswerNoneUse != "alternativeDNS" && d.WhenPrimaryDNSAnswerNoneUse != "AlternativeDNS" {
+			if !d.isAnswerNoneUseAlternative(primaryResponse) {
 				log.Debug("primaryDNS response has no answer section but exist, finally use primaryDNS")
 				return PrimaryClientBundle
 			} else {
@@ -148,6 +435,9 @@ func (d *Dispatcher) selectByIPNetwork(PrimaryClientBundle, AlternativeClientBun
 				return AlternativeClientBundle
 			}
 		}
+	} else if !d.isTimeoutUseAlternative(PrimaryClientBundle, AlternativeClientBundle) {
+		log.Debug("Primary DNS return nil, finally use primary DNS")
+		return PrimaryClientBundle
 	} else {
 		log.Debug("Primary DNS return nil, finally use alternative DNS")
 		waitAlternateResp()
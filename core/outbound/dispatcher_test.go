@@ -1,15 +1,21 @@
 package outbound
 
 import (
+	"context"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 
+	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
 	"github.com/shawn1m/overture/core/config"
+	"github.com/shawn1m/overture/core/records"
+	"github.com/shawn1m/overture/core/zone"
 )
 
 var dispatcher Dispatcher
@@ -19,22 +25,33 @@ func init() {
 	os.Chdir("../..")
 	conf := config.NewConfig("config.test.yml")
 	dispatcher = Dispatcher{
-		PrimaryDNS:                  conf.PrimaryDNS,
-		AlternativeDNS:              conf.AlternativeDNS,
-		OnlyPrimaryDNS:              conf.OnlyPrimaryDNS,
-		WhenPrimaryDNSAnswerNoneUse: conf.WhenPrimaryDNSAnswerNoneUse,
-		IPNetworkPrimarySet:         conf.IPNetworkPrimarySet,
-		IPNetworkAlternativeSet:     conf.IPNetworkAlternativeSet,
-		DomainPrimaryList:           conf.DomainPrimaryList,
-		DomainAlternativeList:       conf.DomainAlternativeList,
+		PrimaryDNS:              conf.PrimaryDNS,
+		AlternativeDNS:          conf.AlternativeDNS,
+		OnlyPrimaryDNS:          conf.OnlyPrimaryDNS,
+		Fallback:                conf.Fallback,
+		IPNetworkPrimarySet:     conf.IPNetworkPrimarySet,
+		IPNetworkAlternativeSet: conf.IPNetworkAlternativeSet,
+		DomainPrimaryList:       conf.DomainPrimaryList,
+		DomainAlternativeList:   conf.DomainAlternativeList,
 
 		RedirectIPv6Record:       conf.IPv6UseAlternativeDNS,
+		AAAAPolicy:               conf.AAAAPolicyList,
+		DNS64:                    conf.DNS64Policy,
 		AlternativeDNSConcurrent: conf.AlternativeDNSConcurrent,
+		QueryTimeout:             time.Duration(conf.QueryTimeout) * time.Second,
+		PrimaryDNSSEC:            conf.DNSSEC.Primary,
+		AlternativeDNSSEC:        conf.DNSSEC.Alternative,
+		TrustAnchors:             conf.TrustAnchors,
+		ForwardZones:             conf.ForwardZones,
 		MinimumTTL:               conf.MinimumTTL,
 		DomainTTLMap:             conf.DomainTTLMap,
+		LocalSpecialUseNames:     conf.LocalSpecialUseNames,
 
-		Hosts: conf.Hosts,
-		Cache: conf.Cache,
+		Zones:        conf.LocalZones,
+		Hosts:        conf.Hosts,
+		Leases:       conf.Leases,
+		LocalRecords: conf.Records,
+		Cache:        conf.Cache,
 	}
 	dispatcher.Init()
 }
@@ -99,5 +116,188 @@ func exchange(z string, t uint16) *dns.Msg {
 
 	q := new(dns.Msg)
 	q.SetQuestion(z, t)
-	return dispatcher.Exchange(q, "")
+	return dispatcher.Exchange(context.Background(), q, "")
+}
+
+func TestDispatcher_QueryTimeout(t *testing.T) {
+	// An upstream that never answers, and whose own timeout is far beyond the query timeout
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	u := &common.DNSUpstream{Name: "blackhole", Address: conn.LocalAddr().String(), Protocol: "udp", Timeout: 30,
+		EDNSClientSubnet: &common.EDNSClientSubnetType{Policy: "disable"}}
+	d := Dispatcher{PrimaryDNS: []*common.DNSUpstream{u}, AlternativeDNS: []*common.DNSUpstream{u},
+		IPNetworkPrimarySet: common.NewIPSet(nil), IPNetworkAlternativeSet: common.NewIPSet(nil),
+		QueryTimeout: 100 * time.Millisecond, Cache: cache.New(10, "", 0, 60)}
+	d.Init()
+
+	q := new(dns.Msg)
+	q.SetQuestion(questionDomain, dns.TypeA)
+	q.SetEdns0(4096, false)
+	start := time.Now()
+	resp := d.Exchange(context.Background(), q, "127.0.0.1")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("query took %s", elapsed)
+	}
+	if resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", resp)
+	}
+
+	// An expired answer is served stale instead
+	expired := new(dns.Msg)
+	expired.SetReply(q)
+	rr, _ := dns.NewRR(questionDomain + " 0 IN A 192.0.2.1")
+	expired.Answer = append(expired.Answer, rr)
+	d.Cache.InsertMessage(cache.Key(q.Question[0], ""), expired, 0, "Primary")
+	start = time.Now()
+	resp = d.Exchange(context.Background(), q, "127.0.0.1")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("query took %s", elapsed)
+	}
+	if common.FindRecordByType(resp, dns.TypeA) != "192.0.2.1" || resp.Answer[0].Header().Ttl != cache.StaleTTL {
+		t.Errorf("expected stale answer, got %v", resp)
+	}
+}
+
+// serveRcode answers every query with an empty response of rcode over UDP, counts the queries in n and
+// returns the upstream of it
+func serveRcode(t *testing.T, rcode int, n *int32) *common.DNSUpstream {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddInt32(n, 1)
+		resp := new(dns.Msg)
+		resp.SetRcode(q, rcode)
+		w.WriteMsg(resp)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return &common.DNSUpstream{Name: dns.RcodeToString[rcode], Address: pc.LocalAddr().String(), Protocol: "udp", Timeout: 2}
+}
+
+func TestDispatcher_Fallback(t *testing.T) {
+	retry := &common.FallbackPolicy{Timeout: common.FallbackRetry, ServFail: common.FallbackRetry, NoData: common.FallbackRetry}
+	q := new(dns.Msg)
+	q.SetQuestion(questionDomain, dns.TypeA)
+
+	var primary, alternative int32
+	d := Dispatcher{PrimaryDNS: []*common.DNSUpstream{serveRcode(t, dns.RcodeServerFailure, &primary)},
+		AlternativeDNS: []*common.DNSUpstream{serveRcode(t, dns.RcodeServerFailure, &alternative)},
+		OnlyPrimaryDNS: true, Fallback: retry, WhenPrimaryDNSAnswerNoneUse: "alternativeDNS"}
+	d.Init()
+	d.Exchange(context.Background(), q, "127.0.0.1")
+	if p, a := atomic.LoadInt32(&primary), atomic.LoadInt32(&alternative); p != 1 || a != 0 {
+		t.Errorf("onlyPrimaryDNS should never query alternative DNS, got %d primary and %d alternative queries", p, a)
+	}
+
+	var answerless, failing int32
+	d = Dispatcher{PrimaryDNS: []*common.DNSUpstream{serveRcode(t, dns.RcodeSuccess, &answerless)},
+		AlternativeDNS:      []*common.DNSUpstream{serveRcode(t, dns.RcodeServerFailure, &failing)},
+		IPNetworkPrimarySet: common.NewIPSet(nil), IPNetworkAlternativeSet: common.NewIPSet(nil), Fallback: retry}
+	d.Init()
+	d.Exchange(context.Background(), q, "127.0.0.1")
+	if p, a := atomic.LoadInt32(&answerless), atomic.LoadInt32(&failing); p != 1 || a != 1 {
+		t.Errorf("every group should be queried once, got %d primary and %d alternative queries", p, a)
+	}
+
+	// An upstream that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	blackhole := &common.DNSUpstream{Name: "blackhole", Address: conn.LocalAddr().String(), Protocol: "udp", Timeout: 1}
+	for action, want := range map[string]int32{common.FallbackReturn: 0, common.FallbackStale: 1, common.FallbackRetry: 1} {
+		var n int32
+		d = Dispatcher{PrimaryDNS: []*common.DNSUpstream{blackhole},
+			AlternativeDNS:      []*common.DNSUpstream{serveRcode(t, dns.RcodeNameError, &n)},
+			IPNetworkPrimarySet: common.NewIPSet(nil), IPNetworkAlternativeSet: common.NewIPSet(nil),
+			Fallback: &common.FallbackPolicy{Timeout: action}}
+		d.Init()
+		d.Exchange(context.Background(), q, "127.0.0.1")
+		if got := atomic.LoadInt32(&n); got != want {
+			t.Errorf("timeout action %s of primary DNS: got %d alternative queries, want %d", action, got, want)
+		}
+	}
+}
+
+func TestDispatcher_LocalRecordsNoData(t *testing.T) {
+	rs := records.New()
+	rr, _ := dns.NewRR("_http._tcp.lan.example. 300 IN SRV 0 0 80 www.lan.example.")
+	rs.Insert(rr)
+	var n int32
+	u := serveRcode(t, dns.RcodeSuccess, &n)
+	d := Dispatcher{PrimaryDNS: []*common.DNSUpstream{u}, AlternativeDNS: []*common.DNSUpstream{u}, OnlyPrimaryDNS: true,
+		LocalRecords: rs, Fallback: &common.FallbackPolicy{}}
+	d.Init()
+
+	q := new(dns.Msg)
+	q.SetQuestion("_http._tcp.lan.example.", dns.TypeTXT)
+	resp := d.Exchange(context.Background(), q, "127.0.0.1")
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("local name without records of the type should be NODATA, got %v", resp)
+	}
+	if got := atomic.LoadInt32(&n); got != 0 {
+		t.Errorf("local name should not be sent upstream, got %d queries", got)
+	}
+}
+
+func TestDispatcher_CheckingDisabled(t *testing.T) {
+	u := serveA(t, "192.0.2.1")
+	d := Dispatcher{PrimaryDNS: []*common.DNSUpstream{u}, AlternativeDNS: []*common.DNSUpstream{u}, OnlyPrimaryDNS: true,
+		PrimaryDNSSEC: true, Cache: cache.New(10, "", 0, 0), Fallback: &common.FallbackPolicy{}}
+	d.Init()
+
+	q := new(dns.Msg)
+	q.SetQuestion(questionDomain, dns.TypeA)
+	cd := q.Copy()
+	cd.CheckingDisabled = true
+	PrimaryClientBundle, AlternativeClientBundle := d.newClientBundles(q, "127.0.0.1")
+	if inflightKey(q, PrimaryClientBundle, AlternativeClientBundle) == inflightKey(cd, PrimaryClientBundle, AlternativeClientBundle) {
+		t.Error("queries with and without CD should not share in-flight exchanges")
+	}
+
+	if resp := d.Exchange(context.Background(), cd, "127.0.0.1"); common.FindRecordByType(resp, dns.TypeA) != "192.0.2.1" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if n := d.Cache.Stats().Length; n != 0 {
+		t.Errorf("unvalidated response should not be cached, got %d entries", n)
+	}
+	d.Exchange(context.Background(), q, "127.0.0.1")
+	if n := d.Cache.Stats().Length; n != 1 {
+		t.Errorf("validated response should be cached, got %d entries", n)
+	}
+}
+
+func TestDispatcher_ZoneCNAME(t *testing.T) {
+	z, err := zone.Parse(strings.NewReader(`
+@     3600 IN SOA ns.lan. admin.lan. 1 3600 600 86400 300
+www   3600 IN A     192.168.1.10
+alias 3600 IN CNAME www
+ext   3600 IN CNAME www.example.
+`), "lan.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs := zone.NewZones()
+	zs.Add(z)
+	u := serveA(t, "192.0.2.1")
+	d := Dispatcher{PrimaryDNS: []*common.DNSUpstream{u}, AlternativeDNS: []*common.DNSUpstream{u}, OnlyPrimaryDNS: true,
+		Zones: zs, Fallback: &common.FallbackPolicy{}}
+	d.Init()
+
+	for name, want := range map[string]string{"alias.lan.": "192.168.1.10", "ext.lan.": "192.0.2.1"} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		resp := d.Exchange(context.Background(), q, "127.0.0.1")
+		if got := common.FindRecordByType(resp, dns.TypeA); len(resp.Answer) != 2 || got != want {
+			t.Errorf("CNAME of %s should be resolved to %s, got %v", name, want, resp)
+		}
+	}
 }
@@ -0,0 +1,50 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+func (d *Dispatcher) isDNS64Client(inboundIP string) bool {
+	return d.DNS64 != nil && d.DNS64.Match(net.ParseIP(inboundIP))
+}
+
+// exchangeDNS64PTR answers PTR questions for addresses under the NAT64 prefix by the PTR records
+// of the embedded IPv4 address, otherwise nil is returned.
+func (d *Dispatcher) exchangeDNS64PTR(ctx context.Context, query *dns.Msg, inboundIP string) *dns.Msg {
+	if query.Question[0].Qtype != dns.TypePTR || !d.isDNS64Client(inboundIP) {
+		return nil
+	}
+	target, ok := d.DNS64.ReverseName(query.Question[0].Name)
+	if !ok {
+		return nil
+	}
+	q := query.Copy()
+	q.Question[0].Name = target
+	resp := d.exchange(ctx, q, inboundIP)
+	if resp == nil {
+		return nil
+	}
+	log.Debugf("DNS64: answer %s by %s", query.Question[0].Name, target)
+	return d.DNS64.SynthesizePTR(query, target, resp)
+}
+
+// exchangeDNS64AAAA synthesizes AAAA records from A records if resp, the response to the AAAA
+// question query, has no AAAA record. Otherwise resp is returned.
+func (d *Dispatcher) exchangeDNS64AAAA(ctx context.Context, query *dns.Msg, inboundIP string, resp *dns.Msg) *dns.Msg {
+	if query.Question[0].Qtype != dns.TypeAAAA || resp == nil || resp.Rcode != dns.RcodeSuccess ||
+		hasRecord(resp, dns.TypeAAAA) || !d.isDNS64Client(inboundIP) {
+		return resp
+	}
+	q := query.Copy()
+	q.Question[0].Qtype = dns.TypeA
+	aResp := d.exchange(ctx, q, inboundIP)
+	if !hasRecord(aResp, dns.TypeA) {
+		return resp
+	}
+	log.Debugf("DNS64: synthesize AAAA records of %s", query.Question[0].Name)
+	return d.DNS64.SynthesizeAAAA(query, aResp)
+}
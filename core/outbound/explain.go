@@ -0,0 +1,184 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/matcher"
+	"github.com/shawn1m/overture/core/outbound/clients"
+	"github.com/shawn1m/overture/core/policy"
+)
+
+// Explanation describes how the dispatcher answers a question.
+type Explanation struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Client string `json:"client"`
+
+	// Stage is one of "reject", "aaaaPolicy", "zone", "local", "forward", "cache", "onlyPrimaryDNS", "domain", "ipv6" and "ipNetwork"
+	Stage   string `json:"stage"`
+	Group   string `json:"group,omitempty"`
+	Matcher string `json:"matcher,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+
+	AnswerIPs []string `json:"answerIPs,omitempty"`
+	IPNetwork string   `json:"ipNetwork,omitempty"`
+
+	Reason string   `json:"reason"`
+	Answer []string `json:"answer,omitempty"`
+}
+
+// Explain follows the dispatch process of Exchange for query and reports which stage,
+// rule and upstream group decide the answer. The cache is looked up without counting
+// or refreshing its entries, and nothing is cached by the explanation itself. The primary
+// DNS is still queried if the IP network decides the group, and the A query made for
+// the preferIPv4 AAAA policy is dispatched, and cached, like any other query.
+func (d *Dispatcher) Explain(ctx context.Context, query *dns.Msg, inboundIP string) *Explanation {
+	e := &Explanation{
+		Name:   query.Question[0].Name,
+		Type:   dns.TypeToString[query.Question[0].Qtype],
+		Client: inboundIP,
+	}
+	PrimaryClientBundle, AlternativeClientBundle := d.newClientBundles(query, inboundIP)
+
+	if action := d.aaaaAction(query, inboundIP); action != policy.AAAAForward {
+		if resp := d.exchangeByAAAAPolicy(ctx, query, inboundIP, action); resp != nil {
+			e.Stage = "aaaaPolicy"
+			e.Reason = "Answered by AAAA policy " + action
+			e.Answer = answerStrings(resp)
+			return e
+		}
+	}
+
+	if z := d.Zones.Find(query.Question[0].Name); z != nil {
+		e.Stage = "zone"
+		e.Rule = z.Origin
+		e.Reason = "Answered from local zone " + z.Origin
+		e.Answer = answerStrings(z.Answer(query))
+		return e
+	}
+
+	localClient := d.newLocalClient(query)
+	if resp := localClient.Exchange(); resp != nil {
+		e.Stage = "local"
+		e.Reason = "Answered from hosts, IP literal or special-use names"
+		e.Answer = answerStrings(resp)
+		return e
+	}
+
+	if z := d.findForwardZone(query.Question[0].Name); z != nil {
+		e.Stage = "forward"
+		e.Group = "Forward " + z.domain
+		e.Rule = z.domain
+		e.Reason = "Domain matched forward zone " + z.domain
+		return e
+	}
+
+	for _, cb := range []*clients.RemoteClientBundle{PrimaryClientBundle, AlternativeClientBundle} {
+		if resp := cb.PeekCache(); resp != nil {
+			e.Stage = "cache"
+			e.Group = cb.Name
+			e.Reason = "Answered from cache"
+			e.Answer = answerStrings(resp)
+			return e
+		}
+	}
+
+	name := PrimaryClientBundle.GetFirstQuestionDomain()
+	if d.OnlyPrimaryDNS {
+		e.Stage = "onlyPrimaryDNS"
+		e.Group = PrimaryClientBundle.Name
+		e.Reason = "onlyPrimaryDNS is enabled"
+		return e
+	}
+	if explainDomain(e, d.DomainPrimaryList, name, PrimaryClientBundle.Name) {
+		return e
+	}
+	if d.isExchangeForIPv6(query) {
+		e.Stage = "ipv6"
+		e.Group = AlternativeClientBundle.Name
+		e.Reason = "ipv6UseAlternativeDNS is enabled"
+		return e
+	}
+	if explainDomain(e, d.DomainAlternativeList, name, AlternativeClientBundle.Name) {
+		return e
+	}
+
+	e.Stage = "ipNetwork"
+	resp := PrimaryClientBundle.Exchange(ctx, false, false)
+	if resp == nil {
+		if d.isTimeoutUseAlternative(PrimaryClientBundle, AlternativeClientBundle) {
+			e.Group = AlternativeClientBundle.Name
+		} else {
+			e.Group = PrimaryClientBundle.Name
+		}
+		e.Reason = "Primary DNS returned nil, decided by fallback policy"
+		return e
+	}
+	e.Answer = answerStrings(resp)
+	if resp.Answer == nil {
+		if !d.isAnswerNoneUseAlternative(resp) {
+			e.Group = PrimaryClientBundle.Name
+		} else {
+			e.Group = AlternativeClientBundle.Name
+		}
+		e.Reason = "Primary DNS response has no answer section, decided by fallback policy"
+		return e
+	}
+
+	for _, a := range resp.Answer {
+		var ip net.IP
+		switch rr := a.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		e.AnswerIPs = append(e.AnswerIPs, ip.String())
+		if e.Group != "" {
+			continue
+		}
+		if r, ok := d.IPNetworkPrimarySet.Range(ip); ok {
+			e.Group = PrimaryClientBundle.Name
+			e.IPNetwork = r
+			e.Reason = "Answer IP of primary DNS is in primary IP network"
+		} else if r, ok := d.IPNetworkAlternativeSet.Range(ip); ok {
+			e.Group = AlternativeClientBundle.Name
+			e.IPNetwork = r
+			e.Reason = "Answer IP of primary DNS is in alternative IP network"
+		}
+	}
+	if e.Group == "" {
+		e.Group = AlternativeClientBundle.Name
+		e.Reason = "IP network match failed"
+	}
+	return e
+}
+
+func explainDomain(e *Explanation, m matcher.Matcher, name string, group string) bool {
+	if m == nil {
+		return false
+	}
+	rule, ok := m.Match(name)
+	if !ok {
+		return false
+	}
+	e.Stage = "domain"
+	e.Group = group
+	e.Matcher = m.Name()
+	e.Rule = rule
+	e.Reason = "Domain matched " + group + " domain list"
+	return true
+}
+
+func answerStrings(m *dns.Msg) []string {
+	var rs []string
+	for _, a := range m.Answer {
+		rs = append(rs, a.String())
+	}
+	return rs
+}
@@ -0,0 +1,106 @@
+package outbound
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/cache"
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/finder/suffix"
+	"github.com/shawn1m/overture/core/outbound/clients"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+)
+
+// forwardZone is a domain answered by its own upstreams instead of primary and alternative DNS
+type forwardZone struct {
+	domain    string
+	upstreams []*common.DNSUpstream
+	resolvers []resolver.Resolver
+}
+
+// initForwardZones indexes the domains of ForwardZones, both a domain and its subdomains map to it
+// so that the most specific domain wins.
+func (d *Dispatcher) initForwardZones() {
+	if len(d.ForwardZones) == 0 {
+		return
+	}
+	d.forwardTree = suffix.NewTree()
+	d.forwardZones = make(map[string]*forwardZone)
+	for _, fz := range d.ForwardZones {
+		resolvers := createResolver(fz.DNS)
+		for _, domain := range fz.Domains {
+			domain = strings.Trim(strings.ToLower(domain), ".")
+			if _, ok := d.forwardZones[domain]; ok {
+				log.Warnf("Forward zone %s is duplicated, the first one is used", domain)
+				continue
+			}
+			if err := d.forwardTree.Insert(domain, domain); err != nil {
+				log.Warnf("Invalid forward zone: %s", err)
+				continue
+			}
+			d.forwardTree.Insert("*."+domain, domain)
+			d.forwardZones[domain] = &forwardZone{domain: domain, upstreams: fz.DNS, resolvers: resolvers}
+		}
+	}
+}
+
+// findForwardZone returns the most specific forward zone of name, or nil
+func (d *Dispatcher) findForwardZone(name string) *forwardZone {
+	if d.forwardTree == nil {
+		return nil
+	}
+	domains := d.forwardTree.Get(name)
+	if len(domains) == 0 {
+		return nil
+	}
+	return d.forwardZones[domains[0]]
+}
+
+// newForwardBundle returns the bundle of the forward zone of the question, or nil if there is none.
+// Responses of forward zones are not validated by DNSSEC.
+func (d *Dispatcher) newForwardBundle(query *dns.Msg, inboundIP string) *clients.RemoteClientBundle {
+	z := d.findForwardZone(query.Question[0].Name)
+	if z == nil {
+		return nil
+	}
+	return clients.NewClientBundle(query, z.upstreams, z.resolvers, inboundIP, d.MinimumTTL, d.Cache, "Forward "+z.domain, d.DomainTTLMap, nil)
+}
+
+func forwardInflightKey(query *dns.Msg, ForwardClientBundle *clients.RemoteClientBundle) string {
+	return cache.Key(query.Question[0], ForwardClientBundle.Name+"/"+ForwardClientBundle.EDNSClientSubnets())
+}
+
+// exchangeForward answers query by the upstreams of its forward zone, neither the domain lists, IP
+// networks nor the fallback policy apply.
+func (d *Dispatcher) exchangeForward(ctx context.Context, query *dns.Msg, inboundIP string, ForwardClientBundle *clients.RemoteClientBundle) *dns.Msg {
+	resp := ForwardClientBundle.ExchangeFromCache()
+	d.Cache.Count(resp != nil)
+	if resp != nil {
+		if _, ok := ForwardClientBundle.PrefetchSource(); ok {
+			d.prefetch(query, inboundIP, ForwardClientBundle.Name)
+		}
+		return resp
+	}
+	if stale := ForwardClientBundle.ExchangeFromStaleCache(); stale != nil {
+		if _, ok := ForwardClientBundle.PrefetchSource(); ok {
+			d.prefetch(query, inboundIP, ForwardClientBundle.Name)
+			return stale
+		}
+	}
+
+	key := forwardInflightKey(query, ForwardClientBundle)
+	resp, shared, err := d.inflight.do(ctx, key, query.Id, func(ctx context.Context) *dns.Msg {
+		log.Debugf("Finally use %s DNS", ForwardClientBundle.Name)
+		return ForwardClientBundle.Exchange(ctx, true, true)
+	})
+	if shared {
+		log.Debugf("Shared in-flight response: %s", key)
+	}
+	if resp == nil && err == context.DeadlineExceeded {
+		return d.exchangeOnDeadline(query, ForwardClientBundle)
+	}
+	return resp
+}
@@ -0,0 +1,90 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+// serveA serves A records of ip for every name over UDP, and returns the upstream of it
+func serveA(t *testing.T, ip string) *common.DNSUpstream {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A " + ip)
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return &common.DNSUpstream{Name: ip, Address: pc.LocalAddr().String(), Protocol: "udp", Timeout: 2}
+}
+
+func TestDispatcher_ForwardZones(t *testing.T) {
+	d := Dispatcher{
+		ForwardZones: []*common.ForwardZone{
+			{Domains: []string{"example", "consul."}, DNS: []*common.DNSUpstream{serveA(t, "192.0.2.1")}},
+			{Domains: []string{"Corp.Example"}, DNS: []*common.DNSUpstream{serveA(t, "192.0.2.2")}},
+		},
+		Fallback: &common.FallbackPolicy{},
+	}
+	d.Init()
+
+	for name, want := range map[string]string{
+		"www.example.":         "192.0.2.1",
+		"corp.example.":        "192.0.2.2",
+		"vpn.corp.example.":    "192.0.2.2",
+		"web.service.consul.":  "192.0.2.1",
+		"www.notcorp.example.": "192.0.2.1",
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		resp := d.Exchange(context.Background(), q, "127.0.0.1")
+		if got := common.FindRecordByType(resp, dns.TypeA); got != want {
+			t.Errorf("%s should be forwarded to %s, got %s", name, want, got)
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("vpn.corp.example.", dns.TypeA)
+	if e := d.Explain(context.Background(), q, "127.0.0.1"); e.Stage != "forward" || e.Rule != "corp.example" {
+		t.Errorf("unexpected explanation %+v", e)
+	}
+}
+
+func TestDispatcher_ForwardSpecialUseNames(t *testing.T) {
+	d := Dispatcher{
+		ForwardZones: []*common.ForwardZone{
+			{Domains: []string{"168.192.in-addr.arpa", "local"}, DNS: []*common.DNSUpstream{serveA(t, "192.0.2.1")}},
+		},
+		LocalSpecialUseNames: true,
+		Fallback:             &common.FallbackPolicy{},
+	}
+	d.Init()
+
+	for _, name := range []string{"1.1.168.192.in-addr.arpa.", "printer.local."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		if resp := d.Exchange(context.Background(), q, "127.0.0.1"); common.FindRecordByType(resp, dns.TypeA) != "192.0.2.1" {
+			t.Errorf("%s should be forwarded, got %v", name, resp)
+		}
+		if e := d.Explain(context.Background(), q, "127.0.0.1"); e.Stage != "forward" {
+			t.Errorf("unexpected explanation of %s %+v", name, e)
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	if resp := d.Exchange(context.Background(), q, "127.0.0.1"); resp == nil || resp.Rcode != dns.RcodeNameError {
+		t.Errorf("special-use name out of forward zones should be NXDOMAIN, got %v", resp)
+	}
+}
@@ -0,0 +1,88 @@
+package outbound
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// inflightCall is an upstream exchange that is in progress or has completed.
+type inflightCall struct {
+	done chan struct{}
+	msg  *dns.Msg
+	// err is context.DeadlineExceeded if the exchange ran out of time without a response
+	err error
+}
+
+// inflightGroup coalesces concurrent upstream exchanges for the same question,
+// so only the first caller (the leader) starts an upstream exchange and all of
+// them wait for its result.
+type inflightGroup struct {
+	sync.Mutex
+	calls map[string]*inflightCall
+	// timeout bounds the shared exchanges, which do not end with the caller starting them
+	timeout time.Duration
+}
+
+func newInflightGroup(timeout time.Duration) *inflightGroup {
+	return &inflightGroup{calls: make(map[string]*inflightCall), timeout: timeout}
+}
+
+// do starts fn for key unless an exchange for key is already in flight, and waits
+// for the exchange or until ctx is done. fn runs with a context of its own bounded
+// by the timeout of the group, so that the callers still waiting get its result
+// when the one which started it goes away. Every caller gets its own copy of the
+// response with the message ID set to id; shared reports whether the exchange
+// was started by another caller. A nil response comes with the error of ctx, or
+// with context.DeadlineExceeded if the exchange ran out of the group timeout.
+func (g *inflightGroup) do(ctx context.Context, key string, id uint16, fn func(ctx context.Context) *dns.Msg) (msg *dns.Msg, shared bool, err error) {
+	g.Lock()
+	c, shared := g.calls[key]
+	if !shared {
+		c = &inflightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go g.run(key, c, fn)
+	}
+	g.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return nil, shared, ctx.Err()
+	}
+	if c.msg == nil {
+		if c.err == nil && deadlineExceeded(ctx) {
+			return nil, shared, context.DeadlineExceeded
+		}
+		return nil, shared, c.err
+	}
+	msg = c.msg.Copy()
+	msg.Id = id
+	return msg, shared, nil
+}
+
+func (g *inflightGroup) run(key string, c *inflightCall, fn func(ctx context.Context) *dns.Msg) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if g.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+	}
+	defer cancel()
+
+	c.msg = fn(ctx)
+	if c.msg == nil && deadlineExceeded(ctx) {
+		c.err = context.DeadlineExceeded
+	}
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	close(c.done)
+}
+
+// deadlineExceeded reports whether the deadline of ctx has passed. Network deadlines set from it may
+// end an exchange just before ctx notices.
+func deadlineExceeded(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ctx.Err() == context.DeadlineExceeded || (ok && !time.Now().Before(deadline))
+}
@@ -0,0 +1,111 @@
+package outbound
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInflightGroup(t *testing.T) {
+	g := newInflightGroup(time.Second)
+	var calls int32
+	release := make(chan struct{})
+
+	fn := func(ctx context.Context) *dns.Msg {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		m := new(dns.Msg)
+		m.SetQuestion(questionDomain, dns.TypeA)
+		m.Id = 1
+		return m
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*dns.Msg, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = g.do(context.Background(), "key", uint16(i+1), fn)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("upstream exchanged %d times, want 1", calls)
+	}
+	for i, m := range results {
+		if m == nil {
+			t.Fatalf("caller %d got nil response", i)
+		}
+		if m.Id != uint16(i+1) {
+			t.Errorf("caller %d got message ID %d", i, m.Id)
+		}
+	}
+}
+
+func TestInflightGroup_FollowerCancel(t *testing.T) {
+	g := newInflightGroup(time.Second)
+	release := make(chan struct{})
+	defer close(release)
+
+	go g.do(context.Background(), "key", 1, func(ctx context.Context) *dns.Msg {
+		<-release
+		return new(dns.Msg)
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if m, shared, err := g.do(ctx, "key", 2, nil); m != nil || !shared || err != context.DeadlineExceeded {
+		t.Errorf("cancelled follower got %v, shared %v, error %v", m, shared, err)
+	}
+}
+
+func TestInflightGroup_LeaderCancel(t *testing.T) {
+	g := newInflightGroup(time.Second)
+	release := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan *dns.Msg)
+	go func() {
+		m, _, _ := g.do(ctx, "key", 1, func(ctx context.Context) *dns.Msg {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(questionDomain, dns.TypeA)
+			return m
+		})
+		leader <- m
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	follower := make(chan *dns.Msg)
+	go func() {
+		m, _, _ := g.do(context.Background(), "key", 2, nil)
+		follower <- m
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if m := <-leader; m != nil {
+		t.Errorf("cancelled leader got %v", m)
+	}
+	close(release)
+	m := <-follower
+	if m == nil {
+		t.Fatal("follower got nil response after the leader was cancelled")
+	}
+	if m.Id != 2 {
+		t.Errorf("follower got message ID %d", m.Id)
+	}
+}
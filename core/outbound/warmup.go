@@ -0,0 +1,47 @@
+package outbound
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// warmUpConcurrency is the number of warm-up questions resolved at the same time.
+const warmUpConcurrency = 8
+
+// WarmUp resolves questions through the normal dispatch process so that their answers are cached.
+func (d *Dispatcher) WarmUp(questions []dns.Question) {
+	if d.Cache == nil || len(questions) == 0 {
+		return
+	}
+
+	start := time.Now()
+	seen := make(map[dns.Question]struct{}, len(questions))
+	sem := make(chan struct{}, warmUpConcurrency)
+	wg := new(sync.WaitGroup)
+	for _, q := range questions {
+		if _, ok := seen[q]; ok {
+			continue
+		}
+		seen[q] = struct{}{}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(q dns.Question) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			m := new(dns.Msg)
+			m.SetQuestion(q.Name, q.Qtype)
+			if d.Exchange(context.Background(), m, "") == nil {
+				log.Debugf("Cache warm-up failed: %s", q.String())
+			}
+		}(q)
+	}
+	wg.Wait()
+	log.Infof("Cache warm-up finished with %d questions in %s", len(seen), time.Since(start))
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+// Package policy implements per-domain and per-client answer policies.
+package policy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/matcher"
+)
+
+// AAAA policy actions
+const (
+	AAAAForward    = "forward"    // forward AAAA queries normally
+	AAAANoData     = "nodata"     // answer AAAA queries with empty NODATA and strip ipv6hint
+	AAAAPreferIPv4 = "preferIPv4" // only return AAAA records when the domain has no A record
+	AAAAStripHint  = "stripHint"  // strip ipv6hint from HTTPS/SVCB answers
+)
+
+// AAAA is an AAAA policy applied to questions for Domains from Clients. A nil Domains
+// or Clients matches everything.
+type AAAA struct {
+	Action  string
+	Domains matcher.Matcher
+	Clients *common.IPSet
+}
+
+func (p *AAAA) match(domain string, client net.IP) bool {
+	if p.Domains != nil && !p.Domains.Has(domain) {
+		return false
+	}
+	if p.Clients != nil && (client == nil || !p.Clients.Contains(client, false, "")) {
+		return false
+	}
+	return true
+}
+
+// AAAAList is a list of AAAA policies where the first match wins.
+type AAAAList []*AAAA
+
+// Action returns the action of the first policy which matches domain and client,
+// AAAAForward is returned if none matches.
+func (l AAAAList) Action(domain string, client net.IP) string {
+	for _, p := range l {
+		if p.match(domain, client) {
+			return p.Action
+		}
+	}
+	return AAAAForward
+}
+
+// StripIPv6Hint removes the ipv6hint parameter from HTTPS and SVCB records in the answer section of m.
+func StripIPv6Hint(m *dns.Msg) {
+	if m == nil {
+		return
+	}
+	for _, rr := range m.Answer {
+		var svcb *dns.SVCB
+		switch r := rr.(type) {
+		case *dns.SVCB:
+			svcb = r
+		case *dns.HTTPS:
+			svcb = &r.SVCB
+		default:
+			continue
+		}
+		values := svcb.Value[:0]
+		for _, v := range svcb.Value {
+			if v.Key() != dns.SVCB_IPV6HINT {
+				values = append(values, v)
+			}
+		}
+		svcb.Value = values
+	}
+}
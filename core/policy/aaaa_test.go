@@ -0,0 +1,55 @@
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/matcher/suffix"
+)
+
+func TestAAAAList_Action(t *testing.T) {
+	domains := suffix.DefaultDomainTree()
+	domains.Insert("broken.example")
+	_, clients, _ := net.ParseCIDR("192.168.1.0/24")
+
+	l := AAAAList{
+		{Action: AAAANoData, Domains: domains},
+		{Action: AAAAPreferIPv4, Clients: common.NewIPSet([]*net.IPNet{clients})},
+	}
+	for _, tt := range []struct {
+		domain string
+		client string
+		action string
+	}{
+		{"www.broken.example", "10.0.0.1", AAAANoData},
+		{"www.example", "192.168.1.10", AAAAPreferIPv4},
+		{"www.example", "10.0.0.1", AAAAForward},
+		{"www.example", "", AAAAForward},
+	} {
+		if action := l.Action(tt.domain, net.ParseIP(tt.client)); action != tt.action {
+			t.Errorf("%s from %s: got %s, want %s", tt.domain, tt.client, action, tt.action)
+		}
+	}
+}
+
+func TestStripIPv6Hint(t *testing.T) {
+	rr, err := dns.NewRR(`example.com. 300 IN HTTPS 1 . alpn="h2" ipv4hint="1.2.3.4" ipv6hint="2001:db8::1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{rr}
+	StripIPv6Hint(m)
+
+	for _, v := range m.Answer[0].(*dns.HTTPS).Value {
+		if v.Key() == dns.SVCB_IPV6HINT {
+			t.Error("ipv6hint should be stripped")
+		}
+	}
+	if len(m.Answer[0].(*dns.HTTPS).Value) != 2 {
+		t.Errorf("other parameters should be kept: %s", m.Answer[0])
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+// DNS64 synthesizes AAAA records from A records under a NAT64 prefix (RFC 6147) for Clients,
+// a nil Clients matches every client.
+type DNS64 struct {
+	Prefix  *net.IPNet
+	Clients *common.IPSet
+}
+
+// NewDNS64 creates a DNS64 policy, prefix must be an IPv6 network of one of the lengths in RFC 6052.
+func NewDNS64(prefix string, clients *common.IPSet) (*DNS64, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 8*net.IPv6len || ipNet.IP.To4() != nil {
+		return nil, errors.New("NAT64 prefix must be an IPv6 network")
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("NAT64 prefix length must be one of 32, 40, 48, 56, 64 and 96, not %d", ones)
+	}
+	return &DNS64{Prefix: ipNet, Clients: clients}, nil
+}
+
+// Match reports whether the policy applies to client.
+func (p *DNS64) Match(client net.IP) bool {
+	return p.Clients == nil || (client != nil && p.Clients.Contains(client, false, ""))
+}
+
+// positions returns the byte offsets of the IPv4 address embedded under the prefix, which skip
+// bits 64 to 71 as RFC 6052 section 2.2.
+func (p *DNS64) positions() []int {
+	ones, _ := p.Prefix.Mask.Size()
+	var ps []int
+	for n := ones / 8; len(ps) < net.IPv4len; n++ {
+		if n != 8 {
+			ps = append(ps, n)
+		}
+	}
+	return ps
+}
+
+// Synthesize embeds ip4 into the prefix.
+func (p *DNS64) Synthesize(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.Prefix.IP.To16())
+	for i, n := range p.positions() {
+		ip[n] = ip4.To4()[i]
+	}
+	return ip
+}
+
+// Extract returns the IPv4 address embedded in ip if ip is under the prefix.
+func (p *DNS64) Extract(ip net.IP) (net.IP, bool) {
+	ip = ip.To16()
+	if ip == nil || !p.Prefix.Contains(ip) {
+		return nil, false
+	}
+	ip4 := make(net.IP, net.IPv4len)
+	for i, n := range p.positions() {
+		ip4[i] = ip[n]
+	}
+	return ip4, true
+}
+
+// SynthesizeAAAA builds the response to the AAAA question q from aResp, the response to the same
+// question of type A. CNAME records are kept and every A record becomes an AAAA record.
+func (p *DNS64) SynthesizeAAAA(q *dns.Msg, aResp *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.RecursionAvailable = aResp.RecursionAvailable
+	for _, rr := range aResp.Answer {
+		switch r := rr.(type) {
+		case *dns.CNAME:
+			resp.Answer = append(resp.Answer, dns.Copy(r))
+		case *dns.A:
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: r.Hdr.Name, Rrtype: dns.TypeAAAA, Class: r.Hdr.Class, Ttl: r.Hdr.Ttl},
+				AAAA: p.Synthesize(r.A),
+			})
+		}
+	}
+	return resp
+}
+
+// ReverseName returns the in-addr.arpa name of the IPv4 address embedded in the ip6.arpa name,
+// if the address is under the prefix.
+func (p *DNS64) ReverseName(name string) (string, bool) {
+	ip := common.ParseReverseName(name)
+	if ip == nil || ip.To4() != nil {
+		return "", false
+	}
+	ip4, ok := p.Extract(ip)
+	if !ok {
+		return "", false
+	}
+	reverse, err := dns.ReverseAddr(ip4.String())
+	if err != nil {
+		return "", false
+	}
+	return reverse, true
+}
+
+// SynthesizePTR builds the response to the PTR question q from ptrResp, the response to the PTR
+// question of target. The answer is a CNAME to target followed by the answer of ptrResp.
+func (p *DNS64) SynthesizePTR(q *dns.Msg, target string, ptrResp *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(q, ptrResp.Rcode)
+	resp.RecursionAvailable = ptrResp.RecursionAvailable
+	ttl := uint32(600)
+	for _, rr := range ptrResp.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	resp.Answer = append(resp.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	})
+	for _, rr := range ptrResp.Answer {
+		if rr.Header().Rrtype == dns.TypePTR || rr.Header().Rrtype == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+	}
+	resp.Ns = append(resp.Ns, ptrResp.Ns...)
+	return resp
+}
@@ -0,0 +1,48 @@
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNS64_Synthesize(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+	} {
+		p, err := NewDNS64(prefix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := p.Synthesize(net.ParseIP("192.0.2.33"))
+		if !ip.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: synthesized %s, want %s", prefix, ip, want)
+		}
+		if ip4, ok := p.Extract(ip); !ok || !ip4.Equal(net.ParseIP("192.0.2.33")) {
+			t.Errorf("%s: extracted %s", prefix, ip4)
+		}
+	}
+
+	if _, err := NewDNS64("64:ff9b::/80", nil); err == nil {
+		t.Error("invalid prefix length should fail")
+	}
+}
+
+func TestDNS64_ReverseName(t *testing.T) {
+	p, _ := NewDNS64("64:ff9b::/96", nil)
+	name, _ := dns.ReverseAddr("64:ff9b::c000:221")
+	if reverse, ok := p.ReverseName(name); !ok || reverse != "33.2.0.192.in-addr.arpa." {
+		t.Errorf("unexpected reverse name %s", reverse)
+	}
+
+	name, _ = dns.ReverseAddr("2001:db8::1")
+	if _, ok := p.ReverseName(name); ok {
+		t.Error("address outside of the prefix should not be reversed")
+	}
+}
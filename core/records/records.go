@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+// Package records provides local records of any type written in zone file syntax.
+package records
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTTL = 3600
+
+// Records are local records matched by exact name, or by the closest wildcard like "*.lan." which
+// matches every subdomain of "lan." without records of its own.
+type Records struct {
+	exact    map[string][]dns.RR
+	wildcard map[string][]dns.RR
+}
+
+func New() *Records {
+	return &Records{exact: make(map[string][]dns.RR), wildcard: make(map[string][]dns.RR)}
+}
+
+// Load reads records from file and records, both in zone file syntax with "." as the origin.
+func Load(file string, records []string) (*Records, error) {
+	rs := New()
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := rs.Parse(f, file); err != nil {
+			return nil, err
+		}
+	}
+	if len(records) > 0 {
+		if err := rs.Parse(strings.NewReader(strings.Join(records, "\n")), ""); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// Parse adds the records in zone file syntax from r, file is used for $INCLUDE and errors.
+func (rs *Records) Parse(r io.Reader, file string) error {
+	zp := dns.NewZoneParser(r, ".", file)
+	zp.SetDefaultTTL(defaultTTL)
+	zp.SetIncludeAllowed(true)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rs.Insert(rr)
+	}
+	return zp.Err()
+}
+
+// Insert adds rr, whose name may be a wildcard.
+func (rs *Records) Insert(rr dns.RR) {
+	name := dns.CanonicalName(rr.Header().Name)
+	rr.Header().Name = name
+	if strings.HasPrefix(name, "*.") {
+		rs.wildcard[name[2:]] = append(rs.wildcard[name[2:]], rr)
+		return
+	}
+	rs.exact[name] = append(rs.exact[name], rr)
+}
+
+// Len returns the number of records.
+func (rs *Records) Len() int {
+	n := 0
+	for _, rrs := range rs.exact {
+		n += len(rrs)
+	}
+	for _, rrs := range rs.wildcard {
+		n += len(rrs)
+	}
+	return n
+}
+
+// Find returns copies of the records of name, records of a wildcard are renamed to name.
+func (rs *Records) Find(name string) []dns.RR {
+	if rs == nil {
+		return nil
+	}
+	name = dns.CanonicalName(name)
+	if rrs, ok := rs.exact[name]; ok {
+		return copyRRs(rrs, name)
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rrs, ok := rs.wildcard[name[off:]]; ok {
+			return copyRRs(rrs, name)
+		}
+	}
+	return nil
+}
+
+func copyRRs(rrs []dns.RR, name string) []dns.RR {
+	result := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		result[i] = dns.Copy(rr)
+		result[i].Header().Name = name
+	}
+	return result
+}
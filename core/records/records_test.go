@@ -0,0 +1,32 @@
+package records
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecords_Find(t *testing.T) {
+	rs, err := Load("", []string{
+		`_http._tcp.lan. IN SRV 0 0 80 web.lan.`,
+		`web.lan. 300 IN TXT "v=1"`,
+		`*.dev.lan. IN CNAME web.lan.`,
+		`lan. IN CAA 0 issue "letsencrypt.org"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 4 {
+		t.Errorf("loaded %d records", rs.Len())
+	}
+
+	if rrs := rs.Find("_HTTP._tcp.lan."); len(rrs) != 1 || rrs[0].Header().Rrtype != dns.TypeSRV || rrs[0].Header().Ttl != defaultTTL {
+		t.Errorf("unexpected records %v", rrs)
+	}
+	if rrs := rs.Find("a.b.dev.lan."); len(rrs) != 1 || rrs[0].Header().Name != "a.b.dev.lan." {
+		t.Errorf("wildcard should match with the question name, got %v", rrs)
+	}
+	if rrs := rs.Find("dev.lan."); len(rrs) != 0 {
+		t.Errorf("wildcard should not match its parent, got %v", rrs)
+	}
+}
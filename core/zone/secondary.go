@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package zone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+const (
+	// retryWithoutZone is the interval of transfers before the zone is first received
+	retryWithoutZone = time.Minute
+	// lookupTimeout bounds the resolution of the primary server name when checking a NOTIFY
+	lookupTimeout = 5 * time.Second
+)
+
+// Secondary keeps a copy of a zone transferred from its primary server, which is refreshed as the
+// SOA record of the zone describes or when the primary server sends a NOTIFY (RFC 1996).
+type Secondary struct {
+	Origin  string
+	Primary string
+	// File, if set, keeps the zone so that it is served before the primary server is reachable
+	File string
+	// TSIGKey and TSIGSecret sign the requests to the primary server with HMAC-SHA256 if set
+	TSIGKey       string
+	TSIGSecret    string
+	AllowTransfer *common.IPSet
+
+	zones     *Zones
+	notify    chan struct{}
+	refreshed time.Time
+}
+
+// NewSecondary creates a secondary zone of origin, port 53 is used if primary has no port.
+func NewSecondary(origin string, primary string) *Secondary {
+	if _, _, err := net.SplitHostPort(primary); err != nil {
+		primary = net.JoinHostPort(primary, "53")
+	}
+	return &Secondary{
+		Origin:  dns.CanonicalName(origin),
+		Primary: primary,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// load serves the zone kept in File, whose modification time is the time of the last refresh.
+func (s *Secondary) load() {
+	if s.File == "" {
+		return
+	}
+	info, err := os.Stat(s.File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to load secondary zone %s: %s", s.Origin, err)
+		}
+		return
+	}
+	z, err := Load(s.Origin, s.File)
+	if err != nil {
+		log.Warnf("Failed to load secondary zone %s: %s", s.Origin, err)
+		return
+	}
+	z.AllowTransfer = s.AllowTransfer
+	s.zones.Add(z)
+	s.refreshed = info.ModTime()
+	log.Infof("Secondary zone %s has been loaded from %s with serial %d", s.Origin, s.File, z.SOA.Serial)
+}
+
+// Notify asks for a refresh, it reports whether from is the primary server.
+func (s *Secondary) Notify(from net.IP) bool {
+	if !s.isPrimary(from) {
+		return false
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// isPrimary reports whether ip is an address of the primary server, whose host is resolved if it is a name
+func (s *Secondary) isPrimary(ip net.IP) bool {
+	host, _, _ := net.SplitHostPort(s.Primary)
+	if primary := net.ParseIP(host); primary != nil {
+		return ip.Equal(primary)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Warnf("Failed to resolve primary server %s of secondary zone %s: %s", host, s.Origin, err)
+		return false
+	}
+	for _, addr := range addrs {
+		if ip.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Secondary) run(ctx context.Context) {
+	for {
+		wait := s.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+			log.Debugf("Refresh secondary zone %s on NOTIFY", s.Origin)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refresh transfers the zone if the serial of the primary server is greater, and returns the interval
+// until the next refresh.
+func (s *Secondary) refresh(ctx context.Context) time.Duration {
+	current := s.zones.Get(s.Origin)
+	if current == nil {
+		if err := s.transfer(ctx, nil); err != nil {
+			log.Warnf("Failed to transfer secondary zone %s from %s: %s", s.Origin, s.Primary, err)
+			return retryWithoutZone
+		}
+		return s.interval(false)
+	}
+
+	serial, err := s.primarySerial(ctx)
+	if err == nil && serialGreater(serial, current.SOA.Serial) {
+		err = s.transfer(ctx, current)
+	}
+	if err != nil {
+		log.Warnf("Failed to refresh secondary zone %s from %s: %s", s.Origin, s.Primary, err)
+		if expire := time.Duration(current.SOA.Expire) * time.Second; time.Since(s.refreshed) > expire {
+			log.Errorf("Secondary zone %s has expired, it is not served until the primary server is reachable", s.Origin)
+			s.zones.Remove(s.Origin)
+			return retryWithoutZone
+		}
+		return s.interval(true)
+	}
+	s.touch()
+	return s.interval(false)
+}
+
+// interval returns the refresh or retry interval in the SOA record
+func (s *Secondary) interval(retry bool) time.Duration {
+	z := s.zones.Get(s.Origin)
+	if z == nil {
+		return retryWithoutZone
+	}
+	z.RLock()
+	defer z.RUnlock()
+	if retry {
+		return time.Duration(z.SOA.Retry) * time.Second
+	}
+	return time.Duration(z.SOA.Refresh) * time.Second
+}
+
+func (s *Secondary) touch() {
+	s.refreshed = time.Now()
+	if s.File != "" {
+		os.Chtimes(s.File, s.refreshed, s.refreshed)
+	}
+}
+
+func (s *Secondary) primarySerial(ctx context.Context) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(s.Origin, dns.TypeSOA)
+	c := &dns.Client{TsigSecret: s.sign(m)}
+	resp, _, err := c.ExchangeContext(ctx, m, s.Primary)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query failed with %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA record in answer")
+}
+
+// transfer receives the zone by IXFR, or by AXFR if current is nil, and serves it.
+func (s *Secondary) transfer(ctx context.Context, current *Zone) error {
+	m := new(dns.Msg)
+	if current == nil {
+		m.SetAxfr(s.Origin)
+	} else {
+		current.RLock()
+		m.SetIxfr(s.Origin, current.SOA.Serial, current.SOA.Ns, current.SOA.Mbox)
+		current.RUnlock()
+	}
+	t := &dns.Transfer{TsigSecret: s.sign(m)}
+
+	var rrs []dns.RR
+	envelopes, err := t.In(m, s.Primary)
+	if err != nil {
+		return err
+	}
+	for e := range envelopes {
+		if e.Error != nil {
+			return e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	z, err := applyTransfer(s.Origin, current, rrs)
+	if err != nil || z == current {
+		return err
+	}
+	z.File, z.AllowTransfer = s.File, s.AllowTransfer
+	s.zones.Add(z)
+	log.Infof("Secondary zone %s has been transferred from %s with serial %d", s.Origin, s.Primary, z.SOA.Serial)
+
+	z.RLock()
+	defer z.RUnlock()
+	if err := z.save(); err != nil {
+		log.Warnf("Failed to save secondary zone %s: %s", s.Origin, err)
+	}
+	return nil
+}
+
+// sign sets TSIG on m, and returns the secrets for the client sending it
+func (s *Secondary) sign(m *dns.Msg) map[string]string {
+	if s.TSIGKey == "" {
+		return nil
+	}
+	key := dns.CanonicalName(s.TSIGKey)
+	m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	return map[string]string{key: s.TSIGSecret}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package zone
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// TransferAllowed reports whether client may transfer the zone.
+func (z *Zone) TransferAllowed(client net.IP) bool {
+	return z.AllowTransfer != nil && client != nil && z.AllowTransfer.Contains(client, false, "")
+}
+
+// Records returns the records of the zone in AXFR order, the SOA record first and last.
+func (z *Zone) Records() []dns.RR {
+	z.RLock()
+	defer z.RUnlock()
+	rrs := []dns.RR{dns.Copy(z.SOA)}
+	for _, records := range z.records {
+		for _, rr := range records {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				rrs = append(rrs, dns.Copy(rr))
+			}
+		}
+	}
+	return append(rrs, dns.Copy(z.SOA))
+}
+
+// Envelopes splits the records of the zone into envelopes of at most size records for an outgoing transfer.
+func (z *Zone) Envelopes(size int) []*dns.Envelope {
+	var envelopes []*dns.Envelope
+	rrs := z.Records()
+	for len(rrs) > size {
+		envelopes = append(envelopes, &dns.Envelope{RR: rrs[:size]})
+		rrs = rrs[size:]
+	}
+	return append(envelopes, &dns.Envelope{RR: rrs})
+}
+
+// clone returns a copy of the zone which can be changed independently.
+func (z *Zone) clone() *Zone {
+	z.RLock()
+	defer z.RUnlock()
+	c := New(z.Origin)
+	c.SOA = z.SOA
+	for name, rrs := range z.records {
+		c.records[name] = append([]dns.RR(nil), rrs...)
+	}
+	for name, n := range z.names {
+		c.names[name] = n
+	}
+	c.File, c.AllowTransfer = z.File, z.AllowTransfer
+	return c
+}
+
+// applyTransfer builds the zone received by an AXFR or IXFR (RFC 1995) transfer of rrs from current,
+// which is nil for AXFR.
+func applyTransfer(origin string, current *Zone, rrs []dns.RR) (*Zone, error) {
+	if len(rrs) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("transfer does not start with SOA record")
+	}
+	if current != nil && !serialGreater(soa.Serial, current.SOA.Serial) {
+		return current, nil
+	}
+
+	// An incremental transfer has the current SOA record after the new one
+	if current != nil && len(rrs) > 2 {
+		if old, ok := rrs[1].(*dns.SOA); ok && old.Serial == current.SOA.Serial {
+			z := current.clone()
+			z.Lock()
+			defer z.Unlock()
+			adding := true
+			for _, rr := range rrs[1 : len(rrs)-1] {
+				name := dns.CanonicalName(rr.Header().Name)
+				if rr.Header().Rrtype == dns.TypeSOA {
+					adding = !adding
+				} else if adding {
+					z.insert(name, rr)
+				} else {
+					z.remove(name, rr)
+				}
+			}
+			z.insert(z.Origin, soa)
+			return z, nil
+		}
+	}
+
+	z := New(origin)
+	for _, rr := range rrs {
+		if err := z.Insert(rr); err != nil {
+			return nil, err
+		}
+	}
+	return z, nil
+}
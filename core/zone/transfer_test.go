@@ -0,0 +1,113 @@
+package zone
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// servePrimary serves primary by AXFR and SOA queries over TCP, and returns its address
+func servePrimary(t *testing.T, primary *Zone) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		if q.Question[0].Qtype == dns.TypeAXFR || q.Question[0].Qtype == dns.TypeIXFR {
+			ch := make(chan *dns.Envelope, 8)
+			for _, e := range primary.Envelopes(3) {
+				ch <- e
+			}
+			close(ch)
+			new(dns.Transfer).Out(w, q, ch)
+			return
+		}
+		w.WriteMsg(primary.Answer(q))
+	})
+	srv := &dns.Server{Listener: l, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return l.Addr().String()
+}
+
+func TestSecondary(t *testing.T) {
+	primary, err := Parse(strings.NewReader(testZone), "lan.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := servePrimary(t, primary)
+
+	zs := NewZones()
+	s := NewSecondary("lan.", address)
+	s.File = filepath.Join(t.TempDir(), "lan.zone")
+	zs.AddSecondary(s)
+	s.refresh(context.Background())
+
+	resp := exchange(t, zs, "www.lan.", dns.TypeA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("secondary zone should be transferred: %s", resp)
+	}
+	if zs.Get("lan.").Len() != primary.Len() {
+		t.Errorf("transferred %d records, want %d", zs.Get("lan.").Len(), primary.Len())
+	}
+
+	reloaded := NewZones()
+	restarted := NewSecondary("lan.", address)
+	restarted.File = s.File
+	reloaded.AddSecondary(restarted)
+	if reloaded.Get("lan.") == nil {
+		t.Error("secondary zone should be loaded from its file")
+	}
+
+	if zs.Notify("lan.", net.ParseIP("192.0.2.1")) {
+		t.Error("NOTIFY from other than the primary server should be refused")
+	}
+	if !zs.Notify("lan.", net.ParseIP("127.0.0.1")) {
+		t.Error("NOTIFY from the primary server should be accepted")
+	}
+}
+
+func TestSecondary_NotifyHostname(t *testing.T) {
+	s := NewSecondary("lan.", "localhost:5353")
+	if !s.Notify(net.ParseIP("127.0.0.1")) {
+		t.Error("NOTIFY from an address of the primary server name should be accepted")
+	}
+	if s.Notify(net.ParseIP("192.0.2.1")) {
+		t.Error("NOTIFY from other than the primary server should be refused")
+	}
+}
+
+func TestApplyTransfer_Incremental(t *testing.T) {
+	current, _ := Parse(strings.NewReader(testZone), "lan.", "")
+	rrs := []dns.RR{
+		newRR(t, "lan. 3600 SOA ns.lan. admin.lan. 3 3600 600 86400 300"),
+		newRR(t, "lan. 3600 SOA ns.lan. admin.lan. 1 3600 600 86400 300"),
+		newRR(t, "www.lan. 3600 A 192.168.1.10"),
+		newRR(t, "lan. 3600 SOA ns.lan. admin.lan. 2 3600 600 86400 300"),
+		newRR(t, "www.lan. 3600 A 192.168.1.11"),
+		newRR(t, "lan. 3600 SOA ns.lan. admin.lan. 2 3600 600 86400 300"),
+		newRR(t, "lan. 3600 SOA ns.lan. admin.lan. 3 3600 600 86400 300"),
+		newRR(t, "new.lan. 3600 A 192.168.1.12"),
+		newRR(t, "lan. 3600 SOA ns.lan. admin.lan. 3 3600 600 86400 300"),
+	}
+	z, err := applyTransfer("lan.", current, rrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z == current || z.SOA.Serial != 3 || z.Len() != current.Len()+1 {
+		t.Fatalf("unexpected zone of serial %d with %d records", z.SOA.Serial, z.Len())
+	}
+	if a := rrsOfType(z.records["www.lan."], dns.TypeA); len(a) != 1 || a[0].(*dns.A).A.String() != "192.168.1.11" {
+		t.Errorf("unexpected records of www.lan.: %v", a)
+	}
+	if a := rrsOfType(current.records["www.lan."], dns.TypeA); a[0].(*dns.A).A.String() != "192.168.1.10" {
+		t.Error("current zone should not be changed")
+	}
+	if !z.exists("new.lan.") || current.exists("new.lan.") {
+		t.Error("names of the zones should follow the transfer")
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package zone
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations of the journal, every line of which is an operation followed by a record in master file format
+const (
+	journalAdd    = "add"
+	journalDelete = "del"
+)
+
+// UpdateAllowed reports whether the TSIG key of name may update the zone.
+func (z *Zone) UpdateAllowed(key string) bool {
+	key = dns.CanonicalName(key)
+	for _, k := range z.AllowUpdate {
+		if dns.CanonicalName(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Update applies the prerequisites and updates of the RFC 2136 UPDATE message m, as unpacked from the
+// wire, and returns the response code. The serial of the SOA record is increased if the zone has
+// changed, and the change is persisted to the journal or the master file of the zone.
+func (z *Zone) Update(m *dns.Msg) int {
+	z.Lock()
+	defer z.Unlock()
+
+	if rcode := z.checkPrerequisites(m.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := z.checkUpdates(m.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	var journal []string
+	serial := z.SOA.Serial
+	for _, rr := range m.Ns {
+		journal = append(journal, z.apply(rr)...)
+	}
+	if len(journal) == 0 {
+		return dns.RcodeSuccess
+	}
+	if z.SOA.Serial == serial {
+		soa := dns.Copy(z.SOA).(*dns.SOA)
+		soa.Serial++
+		z.insert(z.Origin, soa)
+		journal = append(journal, journalAdd+" "+soa.String())
+	}
+
+	if err := z.persist(journal); err != nil {
+		log.Errorf("Failed to persist update of zone %s: %s", z.Origin, err)
+	}
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites checks the prerequisite section as RFC 2136 section 3.2
+func (z *Zone) checkPrerequisites(prerequisites []dns.RR) int {
+	rrsets := make(map[string][]dns.RR)
+	for _, rr := range prerequisites {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(z.Origin, name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if !noRdata(rr) {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(z.records[name]) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(rrsOfType(z.records[name], h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if !noRdata(rr) {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(z.records[name]) != 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(rrsOfType(z.records[name], h.Rrtype)) != 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := name + " " + dns.TypeToString[h.Rrtype]
+			rrsets[key] = append(rrsets[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites must match the whole RRset
+	for _, rrs := range rrsets {
+		h := rrs[0].Header()
+		existing := rrsOfType(z.records[dns.CanonicalName(h.Name)], h.Rrtype)
+		if !sameRRs(existing, rrs) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// checkUpdates prescans the update section as RFC 2136 section 3.4.1
+func (z *Zone) checkUpdates(updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !dns.IsSubDomain(z.Origin, dns.CanonicalName(h.Name)) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if noRdata(rr) || isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || !noRdata(rr) || (h.Rrtype != dns.TypeANY && isMetaType(h.Rrtype)) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || noRdata(rr) || isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// apply applies an update as RFC 2136 section 3.4.2, and returns the journal of the change
+func (z *Zone) apply(rr dns.RR) []string {
+	h := rr.Header()
+	name := dns.CanonicalName(h.Name)
+	var deleted []dns.RR
+	switch h.Class {
+	case dns.ClassINET:
+		existing := z.records[name]
+		switch {
+		case h.Rrtype == dns.TypeSOA:
+			if name != z.Origin || !serialGreater(rr.(*dns.SOA).Serial, z.SOA.Serial) {
+				return nil
+			}
+		case h.Rrtype == dns.TypeCNAME && len(removeType(existing, dns.TypeCNAME)) > 0:
+			return nil
+		case h.Rrtype != dns.TypeCNAME && len(rrsOfType(existing, dns.TypeCNAME)) > 0:
+			return nil
+		case h.Rrtype == dns.TypeCNAME:
+			// A CNAME replaces the existing one
+			deleted = rrsOfType(existing, dns.TypeCNAME)
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		journal := z.deleteRRs(name, deleted)
+		if !z.insert(name, rr) {
+			return journal
+		}
+		return append(journal, journalAdd+" "+rr.String())
+	case dns.ClassANY:
+		for _, r := range z.records[name] {
+			if h.Rrtype == dns.TypeANY || r.Header().Rrtype == h.Rrtype {
+				deleted = append(deleted, r)
+			}
+		}
+	case dns.ClassNONE:
+		for _, r := range z.records[name] {
+			if r.Header().Rrtype == h.Rrtype && equalRdata(r, rr) {
+				deleted = append(deleted, r)
+			}
+		}
+		// The last NS record at the zone apex is never deleted
+		if name == z.Origin && h.Rrtype == dns.TypeNS && len(deleted) == len(rrsOfType(z.records[name], dns.TypeNS)) {
+			return nil
+		}
+	}
+	if name == z.Origin {
+		// SOA and NS records at the zone apex are only deleted one by one
+		deleted = removeType(deleted, dns.TypeSOA)
+		if h.Class == dns.ClassANY {
+			deleted = removeType(deleted, dns.TypeNS)
+		}
+	}
+	return z.deleteRRs(name, deleted)
+}
+
+func (z *Zone) deleteRRs(name string, rrs []dns.RR) []string {
+	var journal []string
+	for _, rr := range copyRRs(rrs) {
+		if z.remove(name, rr) {
+			journal = append(journal, journalDelete+" "+rr.String())
+		}
+	}
+	return journal
+}
+
+// persist appends journal to the journal file of the zone, or rewrites its master file if there is no journal.
+func (z *Zone) persist(journal []string) error {
+	if z.Journal != "" {
+		f, err := os.OpenFile(z.Journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.WriteString(f, strings.Join(journal, "\n")+"\n")
+		return err
+	}
+	return z.save()
+}
+
+// save rewrites the master file of the zone, the caller must hold the lock.
+func (z *Zone) save() error {
+	if z.File == "" {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(z.File), filepath.Base(z.File)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := z.write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), z.File)
+}
+
+// write writes the records of the zone in master file format, the caller must hold the lock.
+func (z *Zone) write(w io.Writer) error {
+	names := make([]string, 0, len(z.records))
+	for name := range z.records {
+		if name != z.Origin {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{z.Origin}, names...)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", z.Origin)
+	fmt.Fprintln(bw, z.SOA.String())
+	for _, name := range names {
+		for _, rr := range z.records[name] {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				fmt.Fprintln(bw, rr.String())
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ReplayJournal applies the changes recorded in the journal file of the zone, a missing journal is not an error.
+func (z *Zone) ReplayJournal() error {
+	f, err := os.Open(z.Journal)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z.Lock()
+	defer z.Unlock()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		op, record, _ := strings.Cut(line, " ")
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil {
+			return fmt.Errorf("%s:%d: bad record: %v", z.Journal, n, err)
+		}
+		name := dns.CanonicalName(rr.Header().Name)
+		switch op {
+		case journalAdd:
+			z.insert(name, rr)
+		case journalDelete:
+			z.remove(name, rr)
+		default:
+			return fmt.Errorf("%s:%d: unknown operation %s", z.Journal, n, op)
+		}
+	}
+	return scanner.Err()
+}
+
+// noRdata reports whether rr, unpacked from an UPDATE message, has no RDATA
+func noRdata(rr dns.RR) bool {
+	_, ok := rr.(*dns.ANY)
+	return ok || rr.Header().Rdlength == 0
+}
+
+func isMetaType(t uint16) bool {
+	switch t {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+	return false
+}
+
+// equalRdata reports whether a and b have the same type and RDATA
+func equalRdata(a dns.RR, b dns.RR) bool {
+	b = dns.Copy(b)
+	h := b.Header()
+	h.Name, h.Class = a.Header().Name, a.Header().Class
+	return dns.IsDuplicate(a, b)
+}
+
+func sameRRs(a []dns.RR, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, r := range rrs {
+			if equalRdata(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// serialGreater compares SOA serials in the serial number arithmetic of RFC 1982
+func serialGreater(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
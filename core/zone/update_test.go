@@ -0,0 +1,132 @@
+package zone
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// update sends m through the wire format as the server receives it
+func update(t *testing.T, z *Zone, m *dns.Msg) int {
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := new(dns.Msg)
+	if err := received.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return z.Update(received)
+}
+
+func TestZone_Update(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "lan.zone")
+	if err := os.WriteFile(file, []byte(testZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := Load("lan.", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs := NewZones()
+	zs.Add(z)
+
+	m := new(dns.Msg)
+	m.SetUpdate("lan.")
+	m.NameUsed([]dns.RR{newRR(t, "host.lan. A 0.0.0.0")})
+	m.Insert([]dns.RR{newRR(t, "host.lan. 300 A 192.168.1.50")})
+	if rcode := update(t, z, m); rcode != dns.RcodeNameError {
+		t.Errorf("prerequisite on a missing name should fail, got %s", dns.RcodeToString[rcode])
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate("lan.")
+	m.NameNotUsed([]dns.RR{newRR(t, "host.lan. A 0.0.0.0")})
+	m.Insert([]dns.RR{newRR(t, "host.lan. 300 A 192.168.1.50"), newRR(t, "alias.lan. 300 A 192.168.1.51")})
+	if rcode := update(t, z, m); rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected rcode %s", dns.RcodeToString[rcode])
+	}
+	if resp := exchange(t, zs, "host.lan.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Errorf("added record should be answered: %s", resp)
+	}
+	if resp := exchange(t, zs, "alias.lan.", dns.TypeA); len(resp.Answer) != 2 {
+		t.Errorf("record should not be added to a CNAME: %s", resp)
+	}
+	if z.SOA.Serial != 2 {
+		t.Errorf("serial should be increased, got %d", z.SOA.Serial)
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate("lan.")
+	m.Used([]dns.RR{newRR(t, "www.lan. A 192.168.1.10")})
+	m.RemoveRRset([]dns.RR{newRR(t, "www.lan. TXT \"\"")})
+	m.Remove([]dns.RR{newRR(t, "ns.lan. A 192.168.1.1")})
+	m.RemoveName([]dns.RR{newRR(t, "lan. A 0.0.0.0")})
+	if rcode := update(t, z, m); rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected rcode %s", dns.RcodeToString[rcode])
+	}
+	if resp := exchange(t, zs, "www.lan.", dns.TypeTXT); len(resp.Answer) != 0 {
+		t.Errorf("RRset should be deleted: %s", resp)
+	}
+	if resp := exchange(t, zs, "ns.lan.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("name should be deleted: %s", resp)
+	}
+	if resp := exchange(t, zs, "lan.", dns.TypeNS); len(resp.Answer) != 1 {
+		t.Errorf("NS at zone apex should be kept: %s", resp)
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate("lan.")
+	m.Insert([]dns.RR{newRR(t, "www.example.com. A 192.168.1.1")})
+	if rcode := update(t, z, m); rcode != dns.RcodeNotZone {
+		t.Errorf("update out of zone should fail, got %s", dns.RcodeToString[rcode])
+	}
+
+	reloaded, err := Load("lan.", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != z.Len() || reloaded.SOA.Serial != 3 {
+		t.Errorf("zone file should be rewritten, got %d records of serial %d", reloaded.Len(), reloaded.SOA.Serial)
+	}
+}
+
+func TestZone_ReplayJournal(t *testing.T) {
+	z, err := Parse(strings.NewReader(testZone), "lan.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Journal = filepath.Join(t.TempDir(), "lan.journal")
+
+	m := new(dns.Msg)
+	m.SetUpdate("lan.")
+	m.Insert([]dns.RR{newRR(t, "host.lan. 300 A 192.168.1.50")})
+	m.RemoveRRset([]dns.RR{newRR(t, "www.lan. A 0.0.0.0")})
+	if rcode := update(t, z, m); rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected rcode %s", dns.RcodeToString[rcode])
+	}
+
+	replayed, _ := Parse(strings.NewReader(testZone), "lan.", "")
+	replayed.Journal = z.Journal
+	if err := replayed.ReplayJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Len() != z.Len() || replayed.SOA.Serial != z.SOA.Serial {
+		t.Errorf("journal should be replayed, got %d records of serial %d", replayed.Len(), replayed.SOA.Serial)
+	}
+	if len(replayed.records["host.lan."]) != 1 || len(rrsOfType(replayed.records["www.lan."], dns.TypeA)) != 0 {
+		t.Errorf("unexpected records after replay")
+	}
+}
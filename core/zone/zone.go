@@ -0,0 +1,330 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+// Package zone implements authoritative zones loaded from RFC 1035 master files.
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+const maxCNAMEs = 8
+
+// Zone is the data of an authoritative zone.
+type Zone struct {
+	sync.RWMutex
+
+	Origin  string
+	SOA     *dns.SOA
+	records map[string][]dns.RR
+	// names counts the owner names at and below every name with records or empty non-terminal
+	names map[string]int
+
+	// File is the master file the zone is loaded from, and Journal, if set, records the
+	// dynamic updates instead of rewriting File.
+	File    string
+	Journal string
+	// AllowUpdate is the names of the TSIG keys which may update the zone
+	AllowUpdate []string
+	// AllowTransfer is the clients which may transfer the zone by AXFR or IXFR
+	AllowTransfer *common.IPSet
+}
+
+func New(origin string) *Zone {
+	return &Zone{Origin: dns.CanonicalName(origin), records: make(map[string][]dns.RR), names: make(map[string]int)}
+}
+
+// Load reads the zone of origin from a master file.
+func Load(origin string, file string) (*Zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := Parse(f, origin, file)
+	if err != nil {
+		return nil, err
+	}
+	z.File = file
+	return z, nil
+}
+
+// Parse reads the zone of origin in master file format from r, file is used for $INCLUDE and errors.
+func Parse(r io.Reader, origin string, file string) (*Zone, error) {
+	z := New(origin)
+	zp := dns.NewZoneParser(r, z.Origin, file)
+	zp.SetIncludeAllowed(true)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if err := z.Insert(rr); err != nil {
+			log.Warnf("Ignore record of zone %s: %s", z.Origin, err)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.SOA == nil {
+		return nil, errors.New("no SOA record at zone apex " + z.Origin)
+	}
+	return z, nil
+}
+
+// Insert adds rr to the zone, the SOA record at the zone apex replaces the existing one.
+func (z *Zone) Insert(rr dns.RR) error {
+	name := dns.CanonicalName(rr.Header().Name)
+	if !dns.IsSubDomain(z.Origin, name) {
+		return fmt.Errorf("%s is out of zone", rr.Header().Name)
+	}
+	if rr.Header().Class != dns.ClassINET {
+		return fmt.Errorf("class of %s is not IN", rr.Header().Name)
+	}
+
+	z.Lock()
+	defer z.Unlock()
+	if _, ok := rr.(*dns.SOA); ok && name != z.Origin {
+		return fmt.Errorf("SOA record %s is not at zone apex", rr.Header().Name)
+	}
+	z.insert(name, rr)
+	return nil
+}
+
+// insert adds rr to the records of name, the caller must hold the lock. It reports whether the zone changed.
+func (z *Zone) insert(name string, rr dns.RR) bool {
+	if _, ok := z.records[name]; !ok {
+		z.addName(name, 1)
+	}
+	if soa, ok := rr.(*dns.SOA); ok {
+		z.SOA = soa
+		z.records[name] = append(removeType(z.records[name], dns.TypeSOA), rr)
+		return true
+	}
+	for i, r := range z.records[name] {
+		if dns.IsDuplicate(r, rr) {
+			if r.Header().Ttl == rr.Header().Ttl {
+				return false
+			}
+			z.records[name][i] = rr
+			return true
+		}
+	}
+	z.records[name] = append(z.records[name], rr)
+	return true
+}
+
+// remove deletes the record equal to rr, the caller must hold the lock. It reports whether the zone changed.
+func (z *Zone) remove(name string, rr dns.RR) bool {
+	for i, r := range z.records[name] {
+		if dns.IsDuplicate(r, rr) {
+			z.records[name] = append(z.records[name][:i:i], z.records[name][i+1:]...)
+			if len(z.records[name]) == 0 {
+				delete(z.records, name)
+				z.addName(name, -1)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// addName adds n to the counts of name and its ancestors in the zone
+func (z *Zone) addName(name string, n int) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		ancestor := name[off:]
+		if !dns.IsSubDomain(z.Origin, ancestor) {
+			break
+		}
+		if z.names[ancestor] += n; z.names[ancestor] <= 0 {
+			delete(z.names, ancestor)
+		}
+	}
+}
+
+// Len returns the number of records in the zone.
+func (z *Zone) Len() int {
+	z.RLock()
+	defer z.RUnlock()
+	n := 0
+	for _, rrs := range z.records {
+		n += len(rrs)
+	}
+	return n
+}
+
+// Answer answers q, whose question must be in the zone, with the AA flag, or a referral if
+// the question is below a zone cut.
+func (z *Zone) Answer(q *dns.Msg) *dns.Msg {
+	z.RLock()
+	defer z.RUnlock()
+
+	question := q.Question[0]
+	name := dns.CanonicalName(question.Name)
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.RecursionAvailable = true
+
+	if cut := z.delegation(name, question.Qtype); cut != "" {
+		resp.Ns = copyRRs(rrsOfType(z.records[cut], dns.TypeNS))
+		resp.Extra = z.additional(resp.Ns)
+		return resp
+	}
+	resp.Authoritative = true
+	z.answer(resp, name, question.Qtype, 0)
+	return resp
+}
+
+func (z *Zone) answer(resp *dns.Msg, name string, qtype uint16, depth int) {
+	rrs, ok := z.records[name]
+	if !ok {
+		rrs, ok = z.wildcard(name)
+	}
+	if !ok {
+		if !z.exists(name) {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Ns = []dns.RR{z.negativeSOA()}
+		return
+	}
+
+	var matched []dns.RR
+	for _, rr := range rrs {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			matched = append(matched, rr)
+		}
+	}
+	if len(matched) > 0 {
+		resp.Answer = append(resp.Answer, copyRRs(matched)...)
+		resp.Extra = append(resp.Extra, z.additional(matched)...)
+		return
+	}
+
+	if cnames := rrsOfType(rrs, dns.TypeCNAME); len(cnames) > 0 {
+		resp.Answer = append(resp.Answer, copyRRs(cnames)...)
+		target := dns.CanonicalName(cnames[0].(*dns.CNAME).Target)
+		if depth < maxCNAMEs && dns.IsSubDomain(z.Origin, target) && z.delegation(target, qtype) == "" {
+			z.answer(resp, target, qtype, depth+1)
+		}
+		return
+	}
+
+	// NODATA
+	resp.Ns = []dns.RR{z.negativeSOA()}
+}
+
+// delegation returns the zone cut at or above name, DS records at a zone cut belong to this zone.
+func (z *Zone) delegation(name string, qtype uint16) string {
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut := name[labels[i]:]
+		if cut == z.Origin || !dns.IsSubDomain(z.Origin, cut) {
+			continue
+		}
+		if cut == name && qtype == dns.TypeDS {
+			return ""
+		}
+		if len(rrsOfType(z.records[cut], dns.TypeNS)) > 0 {
+			return cut
+		}
+	}
+	return ""
+}
+
+// exists reports whether name has records or is an empty non-terminal
+func (z *Zone) exists(name string) bool {
+	return z.names[name] > 0
+}
+
+// wildcard returns the records synthesized for name from the wildcard at its closest encloser
+func (z *Zone) wildcard(name string) ([]dns.RR, bool) {
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+		if !dns.IsSubDomain(z.Origin, encloser) {
+			return nil, false
+		}
+		if !z.exists(encloser) {
+			continue
+		}
+		rrs, ok := z.records["*."+encloser]
+		if !ok {
+			return nil, false
+		}
+		synthesized := copyRRs(rrs)
+		for _, rr := range synthesized {
+			rr.Header().Name = name
+		}
+		return synthesized, true
+	}
+	return nil, false
+}
+
+// additional returns the addresses in the zone of the targets of NS, MX and SRV records
+func (z *Zone) additional(rrs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range rrs {
+		var target string
+		switch r := rr.(type) {
+		case *dns.NS:
+			target = r.Ns
+		case *dns.MX:
+			target = r.Mx
+		case *dns.SRV:
+			target = r.Target
+		default:
+			continue
+		}
+		target = dns.CanonicalName(target)
+		for _, a := range z.records[target] {
+			if t := a.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, dns.Copy(a))
+			}
+		}
+	}
+	return extra
+}
+
+// negativeSOA returns the SOA record for negative answers, whose TTL is the negative caching TTL of RFC 2308
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.SOA).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+func rrsOfType(rrs []dns.RR, t uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+func removeType(rrs []dns.RR, t uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != t {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	result := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		result[i] = dns.Copy(rr)
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+package zone
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `
+$TTL 3600
+@       IN SOA ns.lan. admin.lan. 1 3600 600 86400 300
+@       IN NS  ns
+ns      IN A   192.168.1.1
+www     IN A   192.168.1.10
+        IN TXT "web"
+alias   IN CNAME www
+mail    IN MX  10 mx
+mx      IN A   192.168.1.20
+*.dev   IN A   192.168.1.30
+a.b     IN A   192.168.1.40
+sub     IN NS  ns.sub
+ns.sub  IN A   192.168.2.1
+`
+
+func exchange(t *testing.T, zs *Zones, name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	resp := zs.Exchange(q)
+	if resp == nil {
+		t.Fatalf("no response for %s", name)
+	}
+	return resp
+}
+
+func TestZone(t *testing.T) {
+	z, err := Parse(strings.NewReader(testZone), "lan.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs := NewZones()
+	zs.Add(z)
+
+	resp := exchange(t, zs, "www.lan.", dns.TypeA)
+	if !resp.Authoritative || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.168.1.10" {
+		t.Errorf("unexpected answer: %s", resp)
+	}
+
+	resp = exchange(t, zs, "alias.lan.", dns.TypeA)
+	if len(resp.Answer) != 2 || resp.Answer[1].Header().Rrtype != dns.TypeA {
+		t.Errorf("CNAME should be followed in zone: %s", resp)
+	}
+
+	resp = exchange(t, zs, "mail.lan.", dns.TypeMX)
+	if len(resp.Answer) != 1 || len(resp.Extra) != 1 {
+		t.Errorf("MX target address should be additional: %s", resp)
+	}
+
+	resp = exchange(t, zs, "www.lan.", dns.TypeAAAA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl != 300 {
+		t.Errorf("expected NODATA with SOA: %s", resp)
+	}
+
+	resp = exchange(t, zs, "none.lan.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Errorf("expected NXDOMAIN with SOA: %s", resp)
+	}
+
+	resp = exchange(t, zs, "b.lan.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("empty non-terminal should be NODATA: %s", resp)
+	}
+
+	resp = exchange(t, zs, "x.dev.lan.", dns.TypeA)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "x.dev.lan." {
+		t.Errorf("wildcard should be expanded: %s", resp)
+	}
+
+	resp = exchange(t, zs, "www.sub.lan.", dns.TypeA)
+	if resp.Authoritative || len(resp.Ns) != 1 || len(resp.Extra) != 1 {
+		t.Errorf("expected referral to sub.lan.: %s", resp)
+	}
+
+	resp = exchange(t, zs, "lan.", dns.TypeSOA)
+	if len(resp.Answer) != 1 {
+		t.Errorf("unexpected SOA answer: %s", resp)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	if zs.Exchange(q) != nil {
+		t.Error("question out of zones should not be answered")
+	}
+}
+
+func TestZone_Names(t *testing.T) {
+	z, err := Parse(strings.NewReader(testZone), "lan.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"lan.", "b.lan.", "a.b.lan.", "ns.sub.lan."} {
+		if !z.exists(name) {
+			t.Errorf("%s should exist", name)
+		}
+	}
+
+	rr, _ := dns.NewRR("a.b.lan. 3600 IN A 192.168.1.40")
+	z.Lock()
+	z.remove("a.b.lan.", rr)
+	z.Unlock()
+	if z.exists("a.b.lan.") || z.exists("b.lan.") || !z.exists("lan.") {
+		t.Error("empty non-terminal should be gone with the last name below it")
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package zone
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Zones is a set of authoritative zones, questions are answered by their closest enclosing zone.
+type Zones struct {
+	sync.RWMutex
+	zones       map[string]*Zone
+	secondaries map[string]*Secondary
+	cancel      context.CancelFunc
+}
+
+func NewZones() *Zones {
+	return &Zones{zones: make(map[string]*Zone), secondaries: make(map[string]*Secondary)}
+}
+
+// Add adds z to the set, replacing the zone of the same origin.
+func (zs *Zones) Add(z *Zone) {
+	zs.Lock()
+	defer zs.Unlock()
+	zs.zones[z.Origin] = z
+}
+
+// Remove removes the zone of origin.
+func (zs *Zones) Remove(origin string) {
+	zs.Lock()
+	defer zs.Unlock()
+	delete(zs.zones, dns.CanonicalName(origin))
+}
+
+// AddSecondary adds the secondary zone s, which is served from its file until it is refreshed by Start.
+func (zs *Zones) AddSecondary(s *Secondary) {
+	s.zones = zs
+	zs.Lock()
+	zs.secondaries[s.Origin] = s
+	zs.Unlock()
+	s.load()
+}
+
+// Start starts refreshing the secondary zones until Stop is called.
+func (zs *Zones) Start() {
+	if zs == nil {
+		return
+	}
+	zs.Lock()
+	defer zs.Unlock()
+	if len(zs.secondaries) == 0 || zs.cancel != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, zs.cancel = context.WithCancel(context.Background())
+	for _, s := range zs.secondaries {
+		go s.run(ctx)
+	}
+}
+
+// Stop stops refreshing the secondary zones.
+func (zs *Zones) Stop() {
+	if zs == nil {
+		return
+	}
+	zs.Lock()
+	defer zs.Unlock()
+	if zs.cancel != nil {
+		zs.cancel()
+		zs.cancel = nil
+	}
+}
+
+// Notify handles a NOTIFY of the zone of origin from the client, it reports whether the zone is a
+// secondary zone of the client.
+func (zs *Zones) Notify(origin string, client net.IP) bool {
+	if zs == nil {
+		return false
+	}
+	zs.RLock()
+	s, ok := zs.secondaries[dns.CanonicalName(origin)]
+	zs.RUnlock()
+	return ok && s.Notify(client)
+}
+
+// Get returns the zone of origin.
+func (zs *Zones) Get(origin string) *Zone {
+	if zs == nil {
+		return nil
+	}
+	zs.RLock()
+	defer zs.RUnlock()
+	return zs.zones[dns.CanonicalName(origin)]
+}
+
+// Find returns the closest zone enclosing name, or nil.
+func (zs *Zones) Find(name string) *Zone {
+	if zs == nil {
+		return nil
+	}
+	name = dns.CanonicalName(name)
+	zs.RLock()
+	defer zs.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z, ok := zs.zones[name[off:]]; ok {
+			return z
+		}
+	}
+	return zs.zones["."]
+}
+
+// Exchange answers q from the zone enclosing its question, nil is returned if there is no such zone.
+func (zs *Zones) Exchange(q *dns.Msg) *dns.Msg {
+	if zs == nil || len(q.Question) == 0 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	z := zs.Find(q.Question[0].Name)
+	if z == nil {
+		return nil
+	}
+	return z.Answer(q)
+}
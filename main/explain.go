@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// explain asks the debug HTTP server of a running overture how a question is dispatched.
+//
+//	overture explain [-c config.yml] [-a debugHTTPAddress] [-client ip] name [type]
+func explain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	configPath := fs.String("c", "./config.yml", "config file path, used to find the debug HTTP address")
+	address := fs.String("a", "", "debug HTTP address of the running overture, overrides the config file")
+	client := fs.String("client", "", "inbound IP of the client asking the question")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: overture explain [-c config.yml] [-a debugHTTPAddress] [-client ip] name [type]")
+		return 2
+	}
+
+	if *address == "" {
+		var err error
+		if *address, err = debugHTTPAddress(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read debug HTTP address from config file: %s\n", err)
+			return 1
+		}
+	}
+	if strings.HasPrefix(*address, ":") {
+		*address = "127.0.0.1" + *address
+	}
+
+	query := url.Values{}
+	query.Set("name", fs.Arg(0))
+	if fs.NArg() > 1 {
+		query.Set("type", fs.Arg(1))
+	}
+	if *client != "" {
+		query.Set("client", *client)
+	}
+
+	c := http.Client{Timeout: 30 * time.Second}
+	resp, err := c.Get("http://" + *address + "/explain?" + query.Encode())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to overture: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read response: %s\n", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, body)
+		return 1
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		out.Write(body)
+	}
+	fmt.Println(out.String())
+	return 0
+}
+
+func debugHTTPAddress(configPath string) (string, error) {
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return "", err
+	}
+	var c struct {
+		DebugHTTPAddress string `yaml:"debugHTTPAddress" json:"debugHTTPAddress"`
+	}
+	if strings.HasSuffix(configPath, "json") {
+		err = json.Unmarshal(b, &c)
+	} else {
+		err = yaml.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return "", err
+	}
+	if c.DebugHTTPAddress == "" {
+		return "", fmt.Errorf("debugHTTPAddress is not set")
+	}
+	return c.DebugHTTPAddress, nil
+}
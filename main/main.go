@@ -32,6 +32,10 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		os.Exit(explain(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	if *isShowVersion {
@@ -70,4 +74,5 @@ func main() {
 
 	core.InitServer(*configPath)
 	<-stop
+	core.Stop()
 }